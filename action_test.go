@@ -0,0 +1,92 @@
+package capserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTokenAction(t *testing.T) {
+	keyring, _ := NewKeyring(&SigningKey{ID: "k1", Algorithm: AlgHS256, Secret: []byte("secret")})
+	for name, config := range map[string]*CapConfig{
+		"stored":    {NoFSState: true},
+		"signed":    {NoFSState: true, TokenKeyring: keyring},
+		"stateless": {NoFSState: true, ChallengeSecret: "secret"},
+	} {
+		cap := New(config)
+		defer cap.Close()
+
+		challenge, _ := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Action: "newsletter", Store: name != "stateless"})
+		redeem, _ := cap.RedeemChallenge(&Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)})
+		if !redeem.Success {
+			t.Fatalf("%s: expected redeem to succeed, got %+v", name, redeem)
+		}
+
+		// The mismatch doesn't consume the token
+		resp, _ := cap.ValidateToken(redeem.Token, &TokenConfig{Action: "signup"})
+		if resp.Success || !errors.Is(resp.Err(), ErrActionMismatch) {
+			t.Errorf("%s: expected an action mismatch, got %+v", name, resp)
+		}
+		resp, _ = cap.ValidateToken(redeem.Token, &TokenConfig{KeepToken: true})
+		if !resp.Success || resp.Action != "newsletter" {
+			t.Errorf("%s: expected any action to be accepted and reported, got %+v", name, resp)
+		}
+		resp, _ = cap.ValidateToken(redeem.Token, &TokenConfig{Action: "newsletter"})
+		if !resp.Success {
+			t.Errorf("%s: expected the expected action to pass, got %+v", name, resp)
+		}
+		resp, _ = cap.ValidateToken(redeem.Token, &TokenConfig{Action: "newsletter"})
+		if !errors.Is(resp.Err(), ErrTokenReused) {
+			t.Errorf("%s: expected the token to be spent, got %+v", name, resp)
+		}
+	}
+
+	// Tokens without an action don't pass a check for one
+	cap := New(&CapConfig{NoFSState: true})
+	defer cap.Close()
+	token := redeemSigned(t, cap)
+	if resp, _ := cap.ValidateToken(token, &TokenConfig{Action: "signup"}); resp.Code != ErrActionMismatch.Code {
+		t.Errorf("Expected an action mismatch for a token without one, got %+v", resp)
+	}
+}
+
+func TestDifficultyPolicyKeepsAction(t *testing.T) {
+	cap := New(&CapConfig{
+		NoFSState: true,
+		DifficultyPolicy: func(ctx context.Context, info *RequestInfo, conf *ChallengeConfig) (*ChallengeConfig, error) {
+			return &ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Action: "newsletter", Store: true}, nil
+		},
+	})
+	defer cap.Close()
+
+	challenge, _ := cap.CreateChallenge(&ChallengeConfig{Action: "checkout", Store: true})
+	if data, _ := cap.store.GetChallenge(context.Background(), challenge.Token); data.Action != "checkout" {
+		t.Errorf("Expected the policy to keep the action, got %q", data.Action)
+	}
+}
+
+func TestHandlerSiteverifyAction(t *testing.T) {
+	h := NewHandler(New(&CapConfig{NoFSState: true}), &HandlerOptions{
+		SiteverifySecrets: []string{"backend-secret"},
+		ChallengeConfig: func(r *http.Request) *ChallengeConfig {
+			return &ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Action: "login", Store: true}
+		},
+	})
+	token := redeemThroughHandler(t, h, "https://example.com")
+
+	form := url.Values{"secret": {"backend-secret"}, "response": {token}}
+	req := httptest.NewRequest(http.MethodPost, "/siteverify", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var resp SiteverifyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || !resp.Success || resp.Action != "login" {
+		t.Errorf("Expected the action in the siteverify response, got %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,205 @@
+package capserver
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults of AdaptiveDifficulty
+const (
+	DefaultAdaptiveMinBits    = 12
+	DefaultAdaptiveMaxBits    = 24
+	DefaultAdaptiveWindowMs   = 60000 // 1 minute
+	DefaultAdaptiveMinSamples = 10
+
+	// maxAdaptiveSolveSamples bounds the solve times kept per site and window
+	maxAdaptiveSolveSamples = 1024
+)
+
+// AdaptiveDifficulty configures a controller that sets the difficulty of each
+// site's challenges in leading zero bits, raising it one bit per window when
+// traffic looks abusive and lowering it when things are calm. Challenges whose
+// ChallengeConfig sets a difficulty keep it.
+type AdaptiveDifficulty struct {
+	MinBits        int     `json:"minBits,omitempty"`        // Lowest difficulty (default: DefaultAdaptiveMinBits)
+	MaxBits        int     `json:"maxBits,omitempty"`        // Highest difficulty (default: DefaultAdaptiveMaxBits)
+	InitialBits    int     `json:"initialBits,omitempty"`    // Difficulty sites start at and calm down to (default: MinBits)
+	WindowMs       int     `json:"windowMs,omitempty"`       // Length of the windows traffic is judged over in milliseconds (default: DefaultAdaptiveWindowMs)
+	MaxIssueRate   float64 `json:"maxIssueRate,omitempty"`   // Challenges per second for a site above which difficulty rises (default: 0, not watched)
+	MinSuccessRate float64 `json:"minSuccessRate,omitempty"` // Share of redeems that must succeed, below which difficulty rises (default: 0, not watched)
+	TargetSolveMs  int     `json:"targetSolveMs,omitempty"`  // Median solve time aimed for when there is no abuse (default: 0, calm down to InitialBits instead)
+	MinSamples     int     `json:"minSamples,omitempty"`     // Redeems a window needs before success rate and solve times count (default: DefaultAdaptiveMinSamples)
+}
+
+// DifficultyStats is a site's current adaptive difficulty and the traffic of
+// the last window it was judged on
+type DifficultyStats struct {
+	Bits          int     `json:"bits"`          // Current difficulty in leading zero bits
+	IssueRate     float64 `json:"issueRate"`     // Challenges issued per second
+	Redeems       int     `json:"redeems"`       // Redeem attempts for the site's challenges
+	SuccessRate   float64 `json:"successRate"`   // Share of those that succeeded
+	MedianSolveMs int64   `json:"medianSolveMs"` // Median time from issue to successful redeem
+	WindowEnd     int64   `json:"windowEnd"`     // When the window closed (unix milliseconds), 0 before the first
+}
+
+// adaptiveController tracks traffic per site and adjusts its difficulty
+type adaptiveController struct {
+	config AdaptiveDifficulty
+
+	mu    sync.Mutex
+	sites map[string]*adaptiveSite
+}
+
+// adaptiveSite is the state of one site, "" for challenges without one
+type adaptiveSite struct {
+	bits        int
+	windowStart int64
+	issued      int
+	redeems     int
+	successes   int
+	solveMs     []int64
+	last        DifficultyStats
+}
+
+func newAdaptiveController(config AdaptiveDifficulty) *adaptiveController {
+	if config.MinBits <= 0 {
+		config.MinBits = DefaultAdaptiveMinBits
+	}
+	if config.MaxBits <= 0 {
+		config.MaxBits = DefaultAdaptiveMaxBits
+	}
+	config.MaxBits = max(config.MinBits, min(config.MaxBits, maxDifficultyBits))
+	if config.InitialBits <= 0 {
+		config.InitialBits = config.MinBits
+	}
+	config.InitialBits = max(config.MinBits, min(config.InitialBits, config.MaxBits))
+	if config.WindowMs <= 0 {
+		config.WindowMs = DefaultAdaptiveWindowMs
+	}
+	if config.MinSamples <= 0 {
+		config.MinSamples = DefaultAdaptiveMinSamples
+	}
+
+	return &adaptiveController{config: config, sites: make(map[string]*adaptiveSite)}
+}
+
+// site returns the state of siteKey with its window rolled up to now. The
+// caller must hold a.mu.
+func (a *adaptiveController) site(siteKey string, now int64) *adaptiveSite {
+	s, exists := a.sites[siteKey]
+	if !exists {
+		s = &adaptiveSite{bits: a.config.InitialBits, windowStart: now}
+		s.last.Bits = s.bits
+		a.sites[siteKey] = s
+	}
+	if now-s.windowStart >= int64(a.config.WindowMs) {
+		a.judge(s, now)
+	}
+	return s
+}
+
+// judge closes the window of s, adjusting its difficulty by one bit
+func (a *adaptiveController) judge(s *adaptiveSite, now int64) {
+	stats := DifficultyStats{
+		IssueRate: float64(s.issued) * 1000 / float64(now-s.windowStart),
+		Redeems:   s.redeems,
+		WindowEnd: now,
+	}
+	if s.redeems > 0 {
+		stats.SuccessRate = float64(s.successes) / float64(s.redeems)
+	}
+	if len(s.solveMs) > 0 {
+		sort.Slice(s.solveMs, func(i, j int) bool { return s.solveMs[i] < s.solveMs[j] })
+		stats.MedianSolveMs = s.solveMs[len(s.solveMs)/2]
+	}
+
+	conf := a.config
+	enough := s.redeems >= conf.MinSamples
+	timed := conf.TargetSolveMs > 0 && enough && len(s.solveMs) > 0
+	switch {
+	case conf.MaxIssueRate > 0 && stats.IssueRate > conf.MaxIssueRate,
+		conf.MinSuccessRate > 0 && enough && stats.SuccessRate < conf.MinSuccessRate:
+		s.bits++
+
+	// Solves well under the target point at fast solvers, well over it at suffering users
+	case timed && stats.MedianSolveMs < int64(conf.TargetSolveMs)/2:
+		s.bits++
+	case timed && stats.MedianSolveMs > int64(conf.TargetSolveMs)*2:
+		s.bits--
+	case timed:
+		// Close enough to the target
+
+	// Without abuse or solve times to go by, drift back to the initial difficulty
+	case s.bits > conf.InitialBits:
+		s.bits--
+	case s.bits < conf.InitialBits:
+		s.bits++
+	}
+	s.bits = max(conf.MinBits, min(s.bits, conf.MaxBits))
+
+	stats.Bits = s.bits
+	s.last = stats
+	s.windowStart = now
+	s.issued, s.redeems, s.successes = 0, 0, 0
+	s.solveMs = s.solveMs[:0]
+}
+
+// bits returns the difficulty of siteKey at now
+func (a *adaptiveController) bits(siteKey string, now int64) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.site(siteKey, now).bits
+}
+
+// issued records a challenge issued for siteKey
+func (a *adaptiveController) issued(siteKey string, now int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.site(siteKey, now).issued++
+}
+
+// redeemed records a redeem attempt for a challenge of siteKey issued at
+// issuedAt (unix milliseconds, 0 if unknown)
+func (a *adaptiveController) redeemed(siteKey string, success bool, issuedAt, now int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := a.site(siteKey, now)
+	s.redeems++
+	if !success {
+		return
+	}
+	s.successes++
+	if issuedAt > 0 && len(s.solveMs) < maxAdaptiveSolveSamples {
+		s.solveMs = append(s.solveMs, now-issuedAt)
+	}
+}
+
+// stats returns the difficulty of siteKey at now and its last judged window
+func (a *adaptiveController) stats(siteKey string, now int64) DifficultyStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Sites without traffic aren't tracked yet
+	if _, exists := a.sites[siteKey]; !exists {
+		return DifficultyStats{Bits: a.config.InitialBits}
+	}
+
+	s := a.site(siteKey, now)
+	stats := s.last
+	stats.Bits = s.bits
+	return stats
+}
+
+// DifficultyStats returns the adaptive difficulty of a site, "" for
+// challenges without one, or nil if CapConfig.Adaptive isn't set
+func (c *Cap) DifficultyStats(siteKey string) *DifficultyStats {
+	if c.adaptive == nil {
+		return nil
+	}
+	stats := c.adaptive.stats(siteKey, time.Now().UnixMilli())
+	return &stats
+}
@@ -0,0 +1,114 @@
+package capserver
+
+import (
+	"testing"
+)
+
+func TestAdaptiveController(t *testing.T) {
+	// window runs one window of traffic for site "s" starting at start, then judges it
+	window := func(a *adaptiveController, start int64, issued, redeems, successes int, solveMs int64) int {
+		a.site("s", start)
+		for i := 0; i < issued; i++ {
+			a.issued("s", start)
+		}
+		for i := 0; i < redeems; i++ {
+			a.redeemed("s", i < successes, start-solveMs, start)
+		}
+		return a.bits("s", start+1000)
+	}
+
+	t.Run("issue spikes", func(t *testing.T) {
+		a := newAdaptiveController(AdaptiveDifficulty{MinBits: 10, MaxBits: 12, WindowMs: 1000, MaxIssueRate: 5})
+		for i, want := range []int{11, 12, 12} {
+			if got := window(a, int64(i+1)*1000, 10, 0, 0, 0); got != want {
+				t.Fatalf("Window %d: expected %d bits, got %d", i, want, got)
+			}
+		}
+		// Calm windows drift back to the initial difficulty
+		for i, want := range []int{11, 10, 10} {
+			if got := window(a, int64(i+4)*1000, 2, 0, 0, 0); got != want {
+				t.Fatalf("Calm window %d: expected %d bits, got %d", i, want, got)
+			}
+		}
+
+		stats := a.stats("s", 7000)
+		if stats.Bits != 10 || stats.IssueRate != 2 || stats.WindowEnd != 7000 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("failed redeems", func(t *testing.T) {
+		a := newAdaptiveController(AdaptiveDifficulty{MinBits: 10, WindowMs: 1000, MinSuccessRate: 0.5, MinSamples: 4})
+		if got := window(a, 1000, 0, 3, 0, 0); got != 10 {
+			t.Errorf("Expected too few samples to be ignored, got %d bits", got)
+		}
+		if got := window(a, 2000, 0, 10, 2, 0); got != 11 {
+			t.Errorf("Expected a low success rate to raise difficulty, got %d bits", got)
+		}
+		if stats := a.stats("s", 3000); stats.SuccessRate != 0.2 || stats.Redeems != 10 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("solve times", func(t *testing.T) {
+		a := newAdaptiveController(AdaptiveDifficulty{MinBits: 8, InitialBits: 10, MaxBits: 16, WindowMs: 1000, TargetSolveMs: 1000, MinSamples: 2})
+		for i, tc := range []struct {
+			solveMs int64
+			want    int
+		}{
+			{100, 11},  // Fast solvers
+			{1000, 11}, // On target
+			{3000, 10}, // Slow solvers
+			{3000, 9},
+		} {
+			if got := window(a, int64(i+1)*1000, 0, 5, 5, tc.solveMs); got != tc.want {
+				t.Fatalf("Window %d: expected %d bits, got %d", i, tc.want, got)
+			}
+		}
+		if stats := a.stats("s", 5000); stats.MedianSolveMs != 3000 {
+			t.Errorf("Unexpected median %d", stats.MedianSolveMs)
+		}
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		a := newAdaptiveController(AdaptiveDifficulty{MinBits: 20, MaxBits: 300, InitialBits: 4})
+		if a.config.MaxBits != maxDifficultyBits || a.config.InitialBits != 20 {
+			t.Errorf("Expected bounds to be clamped, got %+v", a.config)
+		}
+	})
+}
+
+func TestAdaptiveDifficulty(t *testing.T) {
+	if stats := New(&CapConfig{NoFSState: true}).DifficultyStats(""); stats != nil {
+		t.Errorf("Expected no stats without Adaptive, got %+v", stats)
+	}
+
+	cap := New(&CapConfig{NoFSState: true, Adaptive: &AdaptiveDifficulty{MinBits: 4, MaxBits: 8}})
+	defer cap.Close()
+
+	if stats := cap.DifficultyStats("unused"); stats.Bits != 4 || len(cap.adaptive.sites) != 0 {
+		t.Errorf("Expected untracked sites to report the initial difficulty, got %+v", stats)
+	}
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	if challenge.Bits != 4 {
+		t.Errorf("Expected the adaptive difficulty, got %+v", challenge)
+	}
+	resp, _ := cap.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: solveWith(t, SHA256(), challenge.Challenge, true)})
+	if !resp.Success {
+		t.Fatalf("Expected redeem to succeed, got %+v", resp)
+	}
+
+	explicit, _ := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true})
+	if explicit.Bits != 0 || len(explicit.Challenge[0][1]) != 1 {
+		t.Errorf("Expected an explicit difficulty to be kept, got %+v", explicit)
+	}
+
+	s := cap.adaptive.sites[""]
+	if s.issued != 2 || s.redeems != 1 || s.successes != 1 || len(s.solveMs) != 1 {
+		t.Errorf("Expected traffic to be recorded, got %+v", s)
+	}
+}
@@ -0,0 +1,95 @@
+package capserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+)
+
+// Networks NewTokenBinding binds client addresses to, in prefix bits
+const (
+	DefaultBindingIPv4Bits = 24
+	DefaultBindingIPv6Bits = 64
+)
+
+// TokenBinding ties a verification token to the client that redeemed it, so
+// tokens handed on to other clients fail validation. Set it on the Solution to
+// record it with the token, and on the TokenConfig to describe the client
+// presenting the token: every attribute the token is bound to must then match.
+// Tokens failing the check aren't consumed.
+type TokenBinding struct {
+	IPPrefix      string `json:"ip,omitempty"`      // Client network in CIDR notation; the presented address or network must lie within it
+	UserAgentHash string `json:"ua,omitempty"`      // Hex SHA-256 of the client's User-Agent
+	SessionHash   string `json:"session,omitempty"` // Hex SHA-256 of the client's session ID
+
+	addressOnly bool // Presented by a caller that only knows the client's address, so nothing else is checked
+}
+
+// NewTokenBinding returns the binding of a client. Its address is widened to a
+// DefaultBindingIPv4Bits or DefaultBindingIPv6Bits network so clients keep
+// their tokens as they move within it, and the user agent and session are
+// hashed so signed tokens don't reveal them. Empty or unparsable attributes
+// are left unbound.
+func NewTokenBinding(clientIP, userAgent, session string) *TokenBinding {
+	b := &TokenBinding{}
+	if addr, err := netip.ParseAddr(clientIP); err == nil {
+		addr = addr.Unmap().WithZone("")
+		bits := DefaultBindingIPv6Bits
+		if addr.Is4() {
+			bits = DefaultBindingIPv4Bits
+		}
+		prefix, _ := addr.Prefix(bits)
+		b.IPPrefix = prefix.String()
+	}
+	if userAgent != "" {
+		b.UserAgentHash = bindingHash(userAgent)
+	}
+	if session != "" {
+		b.SessionHash = bindingHash(session)
+	}
+	return b
+}
+
+// matches reports whether presented, the binding of the client presenting a
+// token bound by b, has every attribute of b. A nil presented binding isn't checked.
+func (b *TokenBinding) matches(presented *TokenBinding) bool {
+	if b == nil || presented == nil {
+		return true
+	}
+	if b.IPPrefix != "" && !prefixContains(b.IPPrefix, presented.IPPrefix) {
+		return false
+	}
+	if presented.addressOnly {
+		return true
+	}
+	if b.UserAgentHash != "" && b.UserAgentHash != presented.UserAgentHash {
+		return false
+	}
+	if b.SessionHash != "" && b.SessionHash != presented.SessionHash {
+		return false
+	}
+	return true
+}
+
+// prefixContains reports whether the address or network inner lies within network
+func prefixContains(network, inner string) bool {
+	outer, err := netip.ParsePrefix(network)
+	if err != nil {
+		return false
+	}
+	in, err := netip.ParsePrefix(inner)
+	if err != nil {
+		addr, err := netip.ParseAddr(inner)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap().WithZone("")
+		in = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return in.Bits() >= outer.Bits() && outer.Contains(in.Addr())
+}
+
+func bindingHash(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
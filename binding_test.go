@@ -0,0 +1,132 @@
+package capserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNewTokenBinding(t *testing.T) {
+	b := NewTokenBinding("203.0.113.7", "Mozilla/5.0", "")
+	if b.IPPrefix != "203.0.113.0/24" || b.UserAgentHash != bindingHash("Mozilla/5.0") || b.SessionHash != "" {
+		t.Errorf("Unexpected binding %+v", b)
+	}
+	if b := NewTokenBinding("2001:db8:1:2::7", "", "s"); b.IPPrefix != "2001:db8:1:2::/64" || b.UserAgentHash != "" {
+		t.Errorf("Unexpected IPv6 binding %+v", b)
+	}
+	if b := NewTokenBinding("::ffff:203.0.113.7", "", ""); b.IPPrefix != "203.0.113.0/24" {
+		t.Errorf("Expected mapped addresses to bind as IPv4, got %+v", b)
+	}
+	if b := NewTokenBinding("not an address", "", ""); b.IPPrefix != "" {
+		t.Errorf("Expected an unparsable address to stay unbound, got %+v", b)
+	}
+}
+
+func TestTokenBindingMatches(t *testing.T) {
+	bound := NewTokenBinding("203.0.113.7", "Mozilla/5.0", "session-1")
+	tests := []struct {
+		name      string
+		presented *TokenBinding
+		want      bool
+	}{
+		{"not checked", nil, true},
+		{"same client", NewTokenBinding("203.0.113.7", "Mozilla/5.0", "session-1"), true},
+		{"same network", NewTokenBinding("203.0.113.200", "Mozilla/5.0", "session-1"), true},
+		{"bare address", &TokenBinding{IPPrefix: "203.0.113.9", UserAgentHash: bound.UserAgentHash, SessionHash: bound.SessionHash}, true},
+		{"other network", NewTokenBinding("198.51.100.7", "Mozilla/5.0", "session-1"), false},
+		{"wider network", &TokenBinding{IPPrefix: "203.0.0.0/16", UserAgentHash: bound.UserAgentHash, SessionHash: bound.SessionHash}, false},
+		{"other user agent", NewTokenBinding("203.0.113.7", "curl/8.0", "session-1"), false},
+		{"other session", NewTokenBinding("203.0.113.7", "Mozilla/5.0", "session-2"), false},
+		{"missing attribute", NewTokenBinding("203.0.113.7", "", "session-1"), false},
+		{"address only", &TokenBinding{IPPrefix: "203.0.113.9", addressOnly: true}, true},
+		{"address only, other network", &TokenBinding{IPPrefix: "198.51.100.7", addressOnly: true}, false},
+	}
+	for _, tt := range tests {
+		if got := bound.matches(tt.presented); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	var unbound *TokenBinding
+	if !unbound.matches(NewTokenBinding("198.51.100.7", "curl/8.0", "")) {
+		t.Error("Expected unbound tokens to match any client")
+	}
+}
+
+func TestTokenBinding(t *testing.T) {
+	keyring, _ := NewKeyring(&SigningKey{ID: "k1", Algorithm: AlgHS256, Secret: []byte("secret")})
+	for name, config := range map[string]*CapConfig{
+		"stored": {NoFSState: true},
+		"signed": {NoFSState: true, TokenKeyring: keyring},
+	} {
+		cap := New(config)
+		defer cap.Close()
+
+		challenge, _ := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true})
+		redeem, _ := cap.RedeemChallenge(&Solution{
+			Token:     challenge.Token,
+			Solutions: solveChallenges(t, challenge.Challenge),
+			Binding:   NewTokenBinding("203.0.113.7", "Mozilla/5.0", "session-1"),
+		})
+		if !redeem.Success {
+			t.Fatalf("%s: expected redeem to succeed, got %+v", name, redeem)
+		}
+
+		// A mismatch doesn't consume the token, so a client that moved can't lose it to the check
+		resp, _ := cap.ValidateToken(redeem.Token, &TokenConfig{Binding: NewTokenBinding("198.51.100.7", "Mozilla/5.0", "session-1")})
+		if resp.Success || !errors.Is(resp.Err(), ErrBindingMismatch) {
+			t.Errorf("%s: expected a binding mismatch from another client, got %+v", name, resp)
+		}
+		resp, _ = cap.ValidateToken(redeem.Token, &TokenConfig{KeepToken: true})
+		if !resp.Success {
+			t.Errorf("%s: expected validation without a binding to skip the check, got %+v", name, resp)
+		}
+		resp, _ = cap.ValidateToken(redeem.Token, &TokenConfig{Binding: NewTokenBinding("203.0.113.8", "Mozilla/5.0", "session-1")})
+		if !resp.Success {
+			t.Errorf("%s: expected the bound client to pass, got %+v", name, resp)
+		}
+		resp, _ = cap.ValidateToken(redeem.Token, &TokenConfig{Binding: NewTokenBinding("203.0.113.8", "Mozilla/5.0", "session-1")})
+		if !errors.Is(resp.Err(), ErrTokenReused) {
+			t.Errorf("%s: expected the token to be spent by the bound client, got %+v", name, resp)
+		}
+	}
+}
+
+func TestHandlerSiteverifyRemoteIP(t *testing.T) {
+	h := NewHandler(New(&CapConfig{NoFSState: true}), &HandlerOptions{
+		SiteverifySecrets: []string{"backend-secret"},
+		ChallengeConfig: func(r *http.Request) *ChallengeConfig {
+			return &ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true}
+		},
+		TokenBinding: func(r *http.Request) *TokenBinding {
+			return NewTokenBinding("203.0.113.7", "Mozilla/5.0", "session-1")
+		},
+	})
+	token := redeemThroughHandler(t, h, "https://example.com")
+
+	siteverify := func(remoteIP string) SiteverifyResponse {
+		form := url.Values{"secret": {"backend-secret"}, "response": {token}, "remoteip": {remoteIP}}
+		req := httptest.NewRequest(http.MethodPost, "/siteverify", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		var resp SiteverifyResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Invalid JSON response %q: %v", rec.Body.String(), err)
+		}
+		return resp
+	}
+
+	if resp := siteverify("198.51.100.7"); resp.Success || len(resp.ErrorCodes) != 1 || resp.ErrorCodes[0] != SiteverifyInvalidResponse {
+		t.Errorf("Expected a token from another client to be rejected, got %+v", resp)
+	}
+	// The user agent and session the token is also bound to aren't known to the backend
+	if resp := siteverify("203.0.113.9"); !resp.Success {
+		t.Errorf("Expected the bound client's network to pass, got %+v", resp)
+	}
+}
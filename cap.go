@@ -1,15 +1,16 @@
 package capserver
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,14 +20,22 @@ type ChallengeTuple [2]string
 // ChallengeData contains the complete challenge information
 type ChallengeData struct {
 	Challenge []ChallengeTuple `json:"challenge"`
+	Seed      *ChallengeSeed   `json:"seed,omitempty"`      // Set instead of Challenge for challenges derived from the token
+	Bits      int              `json:"bits,omitempty"`      // Leading zero bits required, with targets as thresholds, instead of target prefixes
+	Algorithm *PowParams       `json:"algorithm,omitempty"` // Proof-of-work algorithm, if not SHA-256
+	Issued    int64            `json:"issued,omitempty"`    // When the challenge was created (unix milliseconds)
 	Expires   int64            `json:"expires"`
 	Token     string           `json:"token"`
+	SiteKey   string           `json:"siteKey,omitempty"`
+	Decision  string           `json:"decision,omitempty"` // Decision of the DifficultyPolicy that configured the challenge
+	Action    string           `json:"action,omitempty"`   // Action the challenge protects, recorded with the token
 }
 
 // ChallengeState represents the internal state of challenges and tokens
 type ChallengeState struct {
 	ChallengesList map[string]*ChallengeData `json:"challengesList"`
 	TokensList     map[string]int64          `json:"tokensList"`
+	TokensData     map[string]*TokenData     `json:"tokensData,omitempty"` // Extra data for tokens in TokensList that carry more than an expiry
 }
 
 // ChallengeConfig contains configuration options for challenge generation
@@ -34,52 +43,112 @@ type ChallengeConfig struct {
 	ChallengeCount      int  `json:"challengeCount,omitempty"`      // Number of challenges to generate (default: 50)
 	ChallengeSize       int  `json:"challengeSize,omitempty"`       // Size of each challenge in bytes (default: 32)
 	ChallengeDifficulty int  `json:"challengeDifficulty,omitempty"` // Difficulty level (default: 4)
+	DifficultyBits      int  `json:"difficultyBits,omitempty"`      // Leading zero bits the hash must have, used instead of ChallengeDifficulty when set (default: 0)
 	ExpiresMs           int  `json:"expiresMs,omitempty"`           // Expiration time in milliseconds (default: 600000)
 	Store               bool `json:"store,omitempty"`               // Whether to store the challenge in memory (default: true)
+	Seeded              bool `json:"seeded,omitempty"`              // Whether to send a seed the client derives the challenges from (default: false)
+
+	Algorithm PowAlgorithm `json:"-"` // Proof-of-work algorithm (default: the site's, or SHA256())
+
+	SiteKey  string `json:"siteKey,omitempty"`  // Site the challenge is for; unset fields use the site's defaults
+	Decision string `json:"decision,omitempty"` // Name of the policy decision behind this configuration, recorded with the challenge and reported on redeem
+	Action   string `json:"action,omitempty"`   // Action the challenge protects, e.g. "signup", recorded with the verification token (default: "")
 }
 
 // TokenConfig contains configuration options for token validation
 type TokenConfig struct {
-	KeepToken bool `json:"keepToken,omitempty"` // Whether to keep the token after validation
+	KeepToken bool   `json:"keepToken,omitempty"` // Whether to keep the token after validation
+	SiteKey   string `json:"siteKey,omitempty"`   // Site the token must have been redeemed for
+	Action    string `json:"action,omitempty"`    // Action the token must have been solved for (default: "", any)
+
+	Binding *TokenBinding `json:"-"` // Client presenting the token, checked against the token's binding (default: nil, not checked)
 }
 
 // Solution represents a solution to a challenge
 type Solution struct {
 	Token     string          `json:"token"`
 	Solutions [][]interface{} `json:"solutions"` // Array of [salt, target, solution] tuples
+	Tuples    []SolutionTuple `json:"-"`         // Typed tuples, used instead of Solutions when set; filled when decoding JSON
+	Nonces    []string        `json:"-"`         // Nonces matched to the challenges by position, used instead of tuples when set
+	Hostname  string          `json:"-"`         // Hostname of the site the challenge was solved on, recorded with the token
+	Binding   *TokenBinding   `json:"-"`         // Client the token is bound to, recorded with the token (default: nil, unbound)
 }
 
 // CapConfig contains the main configuration for the Cap instance
 type CapConfig struct {
-	TokensStorePath string          `json:"tokensStorePath,omitempty"` // Path to store tokens file
-	State           *ChallengeState `json:"state,omitempty"`           // State configuration
-	NoFSState       bool            `json:"noFSState,omitempty"`       // Whether to disable file-based state storage
+	TokensStorePath     string          `json:"tokensStorePath,omitempty"`     // Path to store tokens file
+	State               *ChallengeState `json:"state,omitempty"`               // State configuration
+	NoFSState           bool            `json:"noFSState,omitempty"`           // Whether to disable file-based state storage
+	Store               Store           `json:"-"`                             // Custom storage backend (default: MemoryStore over State)
+	ChallengeSecret     string          `json:"challengeSecret,omitempty"`     // HMAC secret enabling redeemable stateless challenges (Store: false)
+	TokenKeyring        *Keyring        `json:"-"`                             // Keys for self-verifying signed verification tokens (default: stored tokens)
+	Sites               []*Site         `json:"sites,omitempty"`               // Sites with their own secrets, challenge policy and tokens
+	StoreShards         int             `json:"storeShards,omitempty"`         // Number of lock-striped shards of the default store (default: 1, backed by State)
+	FsyncTokens         bool            `json:"fsyncTokens,omitempty"`         // Whether to fsync token file writes (default: false)
+	TokensWriteBehindMs int             `json:"tokensWriteBehindMs,omitempty"` // Coalesce token file writes over this interval in milliseconds (default: 0, write on every change)
+	TokensJournal       bool            `json:"tokensJournal,omitempty"`       // Whether to append changes to a journal next to the tokens file (default: false)
+	JournalCompactEvery int             `json:"journalCompactEvery,omitempty"` // Journal entries between compactions (default: DefaultJournalCompactEvery)
+	CleanupIntervalMs   int             `json:"cleanupIntervalMs,omitempty"`   // Interval of the background expiry sweep in milliseconds (default: 0, sweep only on calls)
+	PersistChallenges   bool            `json:"persistChallenges,omitempty"`   // Whether to keep outstanding challenges across restarts (default: false)
+	ChallengesStorePath string          `json:"challengesStorePath,omitempty"` // Path to store challenges file (default: next to the tokens file)
+	Hooks               *Hooks          `json:"-"`                             // Callbacks run after each operation (default: none)
+	Logger              Logger          `json:"-"`                             // Receiver of warnings (default: printed to stdout)
+	MaxSolutionHashes   int             `json:"maxSolutionHashes,omitempty"`   // Most SHA-256 evaluations spent verifying one solution, bounding the challenge count times the algorithm's cost (default: DefaultMaxSolutionHashes)
+
+	Adaptive         *AdaptiveDifficulty `json:"adaptive,omitempty"` // Adjusts each site's difficulty to its traffic (default: nil, fixed difficulty)
+	DifficultyPolicy DifficultyPolicy    `json:"-"`                  // Picks the configuration of each challenge from the request (default: nil, use the given configuration)
+
+	MaxMemoryHardVerifications int `json:"maxMemoryHardVerifications,omitempty"` // Solutions to memory-hard challenges verified at once, others wait (default: GOMAXPROCS)
 }
 
 // ChallengeResponse represents the response from CreateChallenge
 type ChallengeResponse struct {
 	Challenge []ChallengeTuple `json:"challenge"`
+	Seed      *ChallengeSeed   `json:"-"`                   // Set instead of Challenge for seeded challenges, sent as the challenge
+	Bits      int              `json:"bits,omitempty"`      // Leading zero bits required; targets are then thresholds the hash prefix must not exceed
+	Algorithm *PowParams       `json:"algorithm,omitempty"` // Proof-of-work algorithm to hash with, if not SHA-256
 	Token     string           `json:"token,omitempty"`
 	Expires   int64            `json:"expires"`
+	Decision  string           `json:"-"` // Decision of the DifficultyPolicy, for hooks
 }
 
 // RedeemResponse represents the response from RedeemChallenge
 type RedeemResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message,omitempty"`
+	Code    string `json:"code,omitempty"` // Reason the solution was rejected, see ErrorForCode
 	Token   string `json:"token,omitempty"`
 	Expires int64  `json:"expires,omitempty"`
+
+	Decision string `json:"-"` // Decision of the DifficultyPolicy recorded with the challenge, for analytics
 }
 
 // ValidationResponse represents the response from ValidateToken
 type ValidationResponse struct {
-	Success bool `json:"success"`
+	Success  bool   `json:"success"`
+	Code     string `json:"code,omitempty"`     // Reason the token was rejected, see ErrorForCode
+	IssuedAt int64  `json:"issuedAt,omitempty"` // When the token was redeemed (unix milliseconds)
+	Hostname string `json:"hostname,omitempty"` // Hostname recorded when the token was redeemed
+	Action   string `json:"action,omitempty"`   // Action the token was solved for
 }
 
 // Cap represents the main Cap instance
 type Cap struct {
 	config *CapConfig
-	mu     sync.RWMutex
+	store  Store
+	replay *replayCache
+	spent  *replayCache
+
+	adaptive   *adaptiveController
+	memoryHard chan struct{} // Slots for memory-hard verifications
+
+	sitesMu sync.RWMutex
+	sites   map[string]*Site
+
+	lastSweep   atomic.Int64
+	closed      atomic.Bool
+	stop        chan struct{}
+	janitorDone chan struct{}
 }
 
 const (
@@ -89,13 +158,18 @@ const (
 	DefaultChallengeDifficulty = 4
 	DefaultExpiresMs           = 600000  // 10 minutes
 	DefaultTokenExpiresMs      = 1200000 // 20 minutes
+	DefaultMaxSolutionHashes   = 10000
+
+	// inlineSweepIntervalMs limits how often API calls sweep expired state themselves
+	inlineSweepIntervalMs = 1000
 )
 
 // New creates a new Cap instance with the given configuration
 func New(configObj *CapConfig) *Cap {
 	config := &CapConfig{
-		TokensStorePath: DefaultTokensStore,
-		NoFSState:       false,
+		TokensStorePath:   DefaultTokensStore,
+		NoFSState:         false,
+		MaxSolutionHashes: DefaultMaxSolutionHashes,
 		State: &ChallengeState{
 			ChallengesList: make(map[string]*ChallengeData),
 			TokensList:     make(map[string]int64),
@@ -112,14 +186,81 @@ func New(configObj *CapConfig) *Cap {
 		if configObj.State != nil {
 			config.State = configObj.State
 		}
+		config.Store = configObj.Store
+		config.ChallengeSecret = configObj.ChallengeSecret
+		config.TokenKeyring = configObj.TokenKeyring
+		config.CleanupIntervalMs = configObj.CleanupIntervalMs
+		config.StoreShards = configObj.StoreShards
+		config.FsyncTokens = configObj.FsyncTokens
+		config.TokensWriteBehindMs = configObj.TokensWriteBehindMs
+		config.TokensJournal = configObj.TokensJournal
+		config.JournalCompactEvery = configObj.JournalCompactEvery
+		config.PersistChallenges = configObj.PersistChallenges
+		config.ChallengesStorePath = configObj.ChallengesStorePath
+		config.Hooks = configObj.Hooks
+		config.Logger = configObj.Logger
+		if configObj.MaxSolutionHashes > 0 {
+			config.MaxSolutionHashes = configObj.MaxSolutionHashes
+		}
+		config.Adaptive = configObj.Adaptive
+		config.DifficultyPolicy = configObj.DifficultyPolicy
+		config.MaxMemoryHardVerifications = configObj.MaxMemoryHardVerifications
 	}
 
 	cap := &Cap{
 		config: config,
+		store:  config.Store,
+		replay: newReplayCache(),
+		spent:  newReplayCache(),
+		sites:  make(map[string]*Site),
+		stop:   make(chan struct{}),
+	}
+
+	if cap.store == nil {
+		path := config.TokensStorePath
+		challengesPath := ""
+		if config.PersistChallenges {
+			challengesPath = config.ChallengesStorePath
+			if challengesPath == "" {
+				challengesPath = challengesPathFor(path)
+			}
+		}
+		if config.NoFSState {
+			path = ""
+			challengesPath = ""
+		}
+		cap.store = NewMemoryStoreWithOptions(MemoryStoreOptions{
+			State:         config.State,
+			Shards:        config.StoreShards,
+			Path:          path,
+			Fsync:         config.FsyncTokens,
+			WriteBehindMs: config.TokensWriteBehindMs,
+			Journal:       config.TokensJournal,
+			CompactEvery:  config.JournalCompactEvery,
+
+			ChallengesPath: challengesPath,
+			Logger:         cap.logf,
+		})
+	}
+
+	if config.Adaptive != nil {
+		cap.adaptive = newAdaptiveController(*config.Adaptive)
+	}
+	if config.MaxMemoryHardVerifications <= 0 {
+		config.MaxMemoryHardVerifications = runtime.GOMAXPROCS(0)
 	}
+	cap.memoryHard = make(chan struct{}, config.MaxMemoryHardVerifications)
 
-	if !config.NoFSState {
-		cap.loadTokens()
+	if configObj != nil {
+		for _, site := range configObj.Sites {
+			if err := cap.AddSite(site); err != nil {
+				cap.logf(context.Background(), "skipping site: %v", err)
+			}
+		}
+	}
+
+	if config.CleanupIntervalMs > 0 {
+		cap.startJanitor(time.Duration(config.CleanupIntervalMs) * time.Millisecond)
 	}
 
 	return cap
@@ -127,45 +268,72 @@ func New(configObj *CapConfig) *Cap {
 
 // CreateChallenge generates a new challenge with the specified configuration
 func (c *Cap) CreateChallenge(conf *ChallengeConfig) (*ChallengeResponse, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return c.CreateChallengeContext(context.Background(), conf)
+}
 
-	c.cleanExpiredTokens()
+// CreateChallengeContext is like CreateChallenge, giving up when ctx is done
+func (c *Cap) CreateChallengeContext(ctx context.Context, conf *ChallengeConfig) (*ChallengeResponse, error) {
+	resp, err := c.createChallenge(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	if c.adaptive != nil {
+		c.adaptive.issued(conf.siteKey(), time.Now().UnixMilli())
+	}
+	if c.config.Hooks != nil && c.config.Hooks.OnChallenge != nil {
+		c.config.Hooks.OnChallenge(withSite(ctx, conf.siteKey()), resp)
+	}
+	return resp, nil
+}
 
-	// Set default values
-	challengeCount := DefaultChallengeCount
-	challengeSize := DefaultChallengeSize
-	challengeDifficulty := DefaultChallengeDifficulty
-	expiresMs := DefaultExpiresMs
-	store := true
+func (c *Cap) createChallenge(ctx context.Context, conf *ChallengeConfig) (*ChallengeResponse, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	if conf != nil {
-		if conf.ChallengeCount > 0 {
-			challengeCount = conf.ChallengeCount
-		}
-		if conf.ChallengeSize > 0 {
-			challengeSize = conf.ChallengeSize
-		}
-		if conf.ChallengeDifficulty > 0 {
-			challengeDifficulty = conf.ChallengeDifficulty
-		}
-		if conf.ExpiresMs > 0 {
-			expiresMs = conf.ExpiresMs
-		}
-		store = conf.Store
+	c.maybeCleanExpired(ctx)
+
+	conf, err := c.applyPolicy(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	params, err := c.challengeParams(conf)
+	if err != nil {
+		return nil, err
+	}
+	store, siteKey, decision := params.store, params.siteKey, params.decision
+
+	// Solutions are verified with one hash per challenge
+	if int64(params.count)*int64(params.cost) > int64(c.config.MaxSolutionHashes) {
+		return nil, fmt.Errorf("challenge count %d at %d SHA-256 evaluations per hash exceeds MaxSolutionHashes (%d)",
+			params.count, params.cost, c.config.MaxSolutionHashes)
+	}
+
+	// Seeded challenges are derived from the token, so only their shape is kept
+	var seed *ChallengeSeed
+	var challenges []ChallengeTuple
+	if params.seeded {
+		seed = &ChallengeSeed{Count: params.count, Size: params.size, Difficulty: params.difficulty, Bits: params.bits}
+	} else {
+		challenges = make([]ChallengeTuple, params.count)
 	}
 
 	// Generate challenges
-	challenges := make([]ChallengeTuple, challengeCount)
-	for i := 0; i < challengeCount; i++ {
-		salt, err := generateRandomHex(challengeSize)
+	for i := range challenges {
+		salt, err := generateRandomHex(params.size)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate salt: %w", err)
 		}
 
-		target, err := generateRandomHex(challengeDifficulty)
-		if err != nil {
-			return nil, fmt.Errorf("failed to generate target: %w", err)
+		target := bitsThreshold(params.bits)
+		if params.bits == 0 {
+			target, err = generateRandomHex(params.difficulty)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate target: %w", err)
+			}
 		}
 
 		challenges[i] = ChallengeTuple{salt, target}
@@ -176,144 +344,546 @@ func (c *Cap) CreateChallenge(conf *ChallengeConfig) (*ChallengeResponse, error)
 		return nil, fmt.Errorf("failed to generate token: %w", err)
 	}
 
-	expires := time.Now().UnixMilli() + int64(expiresMs)
+	now := time.Now().UnixMilli()
+	expires := now + int64(params.expiresMs)
 
 	if !store {
+		if c.config.ChallengeSecret == "" {
+			if params.seeded {
+				return nil, errors.New("seeded challenges need a token: store them or set ChallengeSecret")
+			}
+			return &ChallengeResponse{
+				Challenge: challenges,
+				Bits:      params.bits,
+				Algorithm: params.algorithm,
+				Expires:   expires,
+				Decision:  decision,
+			}, nil
+		}
+
+		// Stateless mode: the token carries the challenge, signed so it can't be altered
+		signed, err := signChallenge([]byte(c.config.ChallengeSecret), &signedChallengePayload{
+			Challenge: challenges,
+			Seed:      seed,
+			Bits:      params.bits,
+			Algorithm: params.algorithm,
+			Issued:    now,
+			Expires:   expires,
+			Nonce:     token,
+			SiteKey:   siteKey,
+			Decision:  decision,
+			Action:    params.action,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign challenge: %w", err)
+		}
+
+		// A shared store lets every instance see the challenge redeemed
+		if c.sharedReplay() {
+			err = c.store.PutChallenge(ctx, replayKey(token), &ChallengeData{Expires: expires, Token: replayKey(token)})
+			if err != nil {
+				return nil, fmt.Errorf("failed to store challenge nonce: %w", err)
+			}
+		}
+
 		return &ChallengeResponse{
 			Challenge: challenges,
+			Seed:      seed,
+			Bits:      params.bits,
+			Algorithm: params.algorithm,
+			Token:     signed,
 			Expires:   expires,
+			Decision:  decision,
 		}, nil
 	}
 
-	c.config.State.ChallengesList[token] = &ChallengeData{
+	err = c.store.PutChallenge(ctx, token, &ChallengeData{
 		Challenge: challenges,
+		Seed:      seed,
+		Bits:      params.bits,
+		Algorithm: params.algorithm,
+		Issued:    now,
 		Expires:   expires,
 		Token:     token,
+		SiteKey:   siteKey,
+		Decision:  decision,
+		Action:    params.action,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store challenge: %w", err)
 	}
 
 	return &ChallengeResponse{
 		Challenge: challenges,
+		Seed:      seed,
+		Bits:      params.bits,
+		Algorithm: params.algorithm,
 		Token:     token,
 		Expires:   expires,
+		Decision:  decision,
 	}, nil
 }
 
+// challengeParams is a ChallengeConfig with site and package defaults applied
+type challengeParams struct {
+	count      int
+	size       int
+	difficulty int        // Target length in hex characters
+	bits       int        // Leading zero bits required instead of a target prefix, if non-zero
+	algorithm  *PowParams // Proof-of-work algorithm, nil for SHA-256
+	cost       int        // SHA-256 evaluations per hash of the algorithm
+	expiresMs  int
+	store      bool
+	seeded     bool
+	siteKey    string
+	decision   string
+	action     string
+}
+
+// challengeParams resolves conf against its site's defaults and the package
+// defaults. Settings in conf override the site's, and whichever level sets a
+// difficulty also picks between prefix and bit difficulty.
+func (c *Cap) challengeParams(conf *ChallengeConfig) (*challengeParams, error) {
+	params := &challengeParams{
+		count:      DefaultChallengeCount,
+		size:       DefaultChallengeSize,
+		difficulty: DefaultChallengeDifficulty,
+		expiresMs:  DefaultExpiresMs,
+		store:      true,
+	}
+
+	if conf != nil && conf.SiteKey != "" {
+		site := c.Site(conf.SiteKey)
+		if site == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSite, conf.SiteKey)
+		}
+		params.siteKey = site.Key
+
+		if site.ChallengeCount > 0 {
+			params.count = site.ChallengeCount
+		}
+		if site.ChallengeSize > 0 {
+			params.size = site.ChallengeSize
+		}
+		if site.ChallengeDifficulty > 0 {
+			params.difficulty = site.ChallengeDifficulty
+		}
+		if site.DifficultyBits > 0 {
+			params.bits = site.DifficultyBits
+		}
+		if site.ExpiresMs > 0 {
+			params.expiresMs = site.ExpiresMs
+		}
+		params.seeded = site.Seeded
+		if site.Algorithm != nil {
+			params.algorithm = powParams(site.Algorithm)
+		}
+	}
+
+	// The adaptive difficulty replaces the defaults, but not a difficulty set in conf
+	if c.adaptive != nil {
+		params.bits = c.adaptive.bits(params.siteKey, time.Now().UnixMilli())
+	}
+
+	if conf != nil {
+		if conf.ChallengeCount > 0 {
+			params.count = conf.ChallengeCount
+		}
+		if conf.ChallengeSize > 0 {
+			params.size = conf.ChallengeSize
+		}
+		if conf.ChallengeDifficulty > 0 {
+			params.difficulty = conf.ChallengeDifficulty
+			params.bits = 0
+		}
+		if conf.DifficultyBits > 0 {
+			params.bits = conf.DifficultyBits
+		}
+		if conf.ExpiresMs > 0 {
+			params.expiresMs = conf.ExpiresMs
+		}
+		params.store = conf.Store
+		params.seeded = params.seeded || conf.Seeded
+		if conf.Algorithm != nil {
+			params.algorithm = powParams(conf.Algorithm)
+		}
+		params.decision = conf.Decision
+		params.action = conf.Action
+	}
+
+	// Challenges are verified with the registered algorithm for their params
+	params.cost = 1
+	if params.algorithm != nil {
+		alg, err := NewPowAlgorithm(*params.algorithm)
+		if err != nil {
+			return nil, err
+		}
+		params.cost = powCost(alg)
+	}
+
+	if params.bits > 0 {
+		if params.bits > maxDifficultyBits {
+			return nil, fmt.Errorf("difficulty of %d bits exceeds the %d-bit hash", params.bits, maxDifficultyBits)
+		}
+		params.difficulty = len(bitsThreshold(params.bits))
+	}
+	return params, nil
+}
+
 // RedeemChallenge validates a challenge solution and returns a verification token
 func (c *Cap) RedeemChallenge(solution *Solution) (*RedeemResponse, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return c.RedeemChallengeContext(context.Background(), solution)
+}
+
+// RedeemChallengeContext is like RedeemChallenge, giving up when ctx is done.
+// A challenge taken before ctx is done stays used.
+func (c *Cap) RedeemChallengeContext(ctx context.Context, solution *Solution) (*RedeemResponse, error) {
+	resp, siteKey, err := c.redeemChallenge(ctx, solution)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Hooks != nil && c.config.Hooks.OnRedeem != nil {
+		c.config.Hooks.OnRedeem(withSite(ctx, siteKey), resp)
+	}
+	return resp, nil
+}
+
+// redeemChallenge does the work of RedeemChallengeContext, also returning the
+// site the challenge was for
+func (c *Cap) redeemChallenge(ctx context.Context, solution *Solution) (*RedeemResponse, string, error) {
+	if c.closed.Load() {
+		return nil, "", ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
 
-	if solution == nil || solution.Token == "" || solution.Solutions == nil {
+	if solution == nil || solution.Token == "" || (solution.Solutions == nil && solution.Tuples == nil && solution.Nonces == nil) {
+		reason := ErrSolutionMissing
+		if solution != nil && solution.Token == "" {
+			reason = ErrChallengeNotFound
+		}
 		return &RedeemResponse{
 			Success: false,
 			Message: "Invalid body",
-		}, nil
+			Code:    reason.Code,
+		}, "", nil
 	}
 
-	c.cleanExpiredTokens()
+	var tuples []SolutionTuple
+	var err error
+	if solution.Nonces == nil {
+		tuples, err = solution.tuples()
+	}
+	if err != nil {
+		return &RedeemResponse{
+			Success: false,
+			Message: fmt.Sprintf("Invalid body: %v", err),
+			Code:    ErrSolutionInvalid.Code,
+		}, "", nil
+	}
 
-	challengeData, exists := c.config.State.ChallengesList[solution.Token]
-	if !exists || challengeData.Expires < time.Now().UnixMilli() {
-		delete(c.config.State.ChallengesList, solution.Token)
+	c.maybeCleanExpired(ctx)
+
+	challengeData, nonce, err := c.peekChallenge(ctx, solution.Token)
+	var reason *Error
+	if err == nil {
+		// Memory-hard hashes are bounded in number as well as in total work. The
+		// slot is taken before the challenge, so a client that gives up waiting
+		// for one can still redeem it.
+		if challengeData.Algorithm != nil && challengeData.Algorithm.Memory > 0 {
+			release, err := c.acquireMemoryHard(ctx)
+			if err != nil {
+				return nil, "", err
+			}
+			defer release()
+		}
+		err = c.claimChallenge(ctx, challengeData, nonce)
+	}
+	if errors.As(err, &reason) {
 		return &RedeemResponse{
 			Success: false,
 			Message: "Challenge expired",
-		}, nil
+			Code:    reason.Code,
+		}, "", nil
+	}
+	if err != nil {
+		return nil, "", err
 	}
 
-	delete(c.config.State.ChallengesList, solution.Token)
+	check, cost, err := challengeData.check()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to verify challenge: %w", err)
+	}
 
 	// Validate all challenges
-	for _, challenge := range challengeData.Challenge {
-		salt, target := challenge[0], challenge[1]
-		found := false
-
-		for _, sol := range solution.Solutions {
-			if len(sol) != 3 {
-				continue
-			}
-
-			solSalt, ok1 := sol[0].(string)
-			solTarget, ok2 := sol[1].(string)
-			solValue := sol[2]
-
-			if !ok1 || !ok2 || solSalt != salt || solTarget != target {
-				continue
-			}
+	maxHashes := c.config.MaxSolutionHashes / cost
+	if solution.Nonces != nil {
+		err = verifyNonces(ctx, challengeData.challenges(), solution.Nonces, check, maxHashes)
+	} else {
+		err = verifyTuples(ctx, challengeData.challenges(), tuples, check, maxHashes)
+	}
+	if c.adaptive != nil && (err == nil || errors.As(err, &reason)) {
+		c.adaptive.redeemed(challengeData.SiteKey, err == nil, challengeData.Issued, time.Now().UnixMilli())
+	}
+	if errors.As(err, &reason) {
+		return &RedeemResponse{
+			Success:  false,
+			Message:  "Invalid solution",
+			Code:     reason.Code,
+			Decision: challengeData.Decision,
+		}, challengeData.SiteKey, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
 
-			// Convert solution value to string
-			var solStr string
-			switch v := solValue.(type) {
-			case string:
-				solStr = v
-			case float64:
-				solStr = fmt.Sprintf("%.0f", v)
-			case int:
-				solStr = fmt.Sprintf("%d", v)
-			default:
-				solStr = fmt.Sprintf("%v", v)
-			}
+	now := time.Now().UnixMilli()
+	tokenExpiresMs := DefaultTokenExpiresMs
+	if site := c.Site(challengeData.SiteKey); site != nil && site.TokenExpiresMs > 0 {
+		tokenExpiresMs = site.TokenExpiresMs
+	}
+	expires := now + int64(tokenExpiresMs)
 
-			// Verify the solution
-			hash := sha256.Sum256([]byte(salt + solStr))
-			hashHex := hex.EncodeToString(hash[:])
+	if c.config.TokenKeyring != nil {
+		nonce, err := generateRandomHex(32)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to generate token nonce: %w", err)
+		}
 
-			if strings.HasPrefix(hashHex, target) {
-				found = true
-				break
+		signed, err := c.config.TokenKeyring.sign(&tokenClaims{
+			Expires:  expires,
+			IssuedAt: now,
+			Nonce:    nonce,
+			Site:     challengeData.SiteKey,
+			Host:     solution.Hostname,
+			Action:   challengeData.Action,
+			Binding:  solution.Binding,
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to sign verification token: %w", err)
+		}
+		// The nonce is recorded so the token can be spent once across instances and restarts
+		if c.sharedReplay() {
+			if err := c.store.PutToken(ctx, tokenNonceKey(nonce), &TokenData{Expires: expires}); err != nil {
+				return nil, "", fmt.Errorf("failed to store token nonce: %w", err)
 			}
 		}
 
-		if !found {
-			return &RedeemResponse{
-				Success: false,
-				Message: "Invalid solution",
-			}, nil
-		}
+		return &RedeemResponse{
+			Success:  true,
+			Token:    signed,
+			Expires:  expires,
+			Decision: challengeData.Decision,
+		}, challengeData.SiteKey, nil
 	}
 
 	// Generate verification token
 	vertoken, err := generateRandomHex(30) // 15 bytes = 30 hex chars
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate verification token: %w", err)
+		return nil, "", fmt.Errorf("failed to generate verification token: %w", err)
 	}
 
-	expires := time.Now().UnixMilli() + DefaultTokenExpiresMs
 	hash := sha256.Sum256([]byte(vertoken))
 	hashHex := hex.EncodeToString(hash[:])
 
 	id, err := generateRandomHex(16) // 8 bytes = 16 hex chars
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate token ID: %w", err)
+		return nil, "", fmt.Errorf("failed to generate token ID: %w", err)
 	}
 
 	key := fmt.Sprintf("%s:%s", id, hashHex)
-	c.config.State.TokensList[key] = expires
+	tokenData := &TokenData{
+		Expires:  expires,
+		IssuedAt: now,
+		Hostname: solution.Hostname,
+		SiteKey:  challengeData.SiteKey,
+		Action:   challengeData.Action,
+		Binding:  solution.Binding,
+	}
+	if err := c.store.PutToken(ctx, key, tokenData); err != nil {
+		return nil, "", fmt.Errorf("failed to store verification token: %w", err)
+	}
+
+	return &RedeemResponse{
+		Success:  true,
+		Token:    fmt.Sprintf("%s:%s", id, vertoken),
+		Expires:  expires,
+		Decision: challengeData.Decision,
+	}, challengeData.SiteKey, nil
+}
 
-	if !c.config.NoFSState {
-		if err := c.saveTokens(); err != nil {
-			// Log error but don't fail the operation
-			fmt.Printf("Warning: failed to save tokens: %v\n", err)
+// peekChallenge returns the challenge identified by token without taking it,
+// and the nonce of stateless challenges. It returns ErrChallengeNotFound if the challenge doesn't exist or was already
+// redeemed, and ErrChallengeExpired if it has expired.
+func (c *Cap) peekChallenge(ctx context.Context, token string) (*ChallengeData, string, error) {
+	now := time.Now().UnixMilli()
+
+	if c.config.ChallengeSecret != "" && isSignedChallenge(token) {
+		payload, err := parseSignedChallenge([]byte(c.config.ChallengeSecret), token)
+		if err != nil {
+			return nil, "", ErrChallengeNotFound
+		}
+		if payload.Expires < now {
+			return nil, "", ErrChallengeExpired
+		}
+		if c.replay.contains(payload.Nonce) {
+			return nil, "", ErrChallengeNotFound
 		}
+
+		return &ChallengeData{
+			Challenge: payload.Challenge,
+			Seed:      payload.Seed,
+			Bits:      payload.Bits,
+			Algorithm: payload.Algorithm,
+			Issued:    payload.Issued,
+			Expires:   payload.Expires,
+			Token:     token,
+			SiteKey:   payload.SiteKey,
+			Decision:  payload.Decision,
+			Action:    payload.Action,
+		}, payload.Nonce, nil
 	}
 
-	return &RedeemResponse{
-		Success: true,
-		Token:   fmt.Sprintf("%s:%s", id, vertoken),
-		Expires: expires,
-	}, nil
+	// Stored challenges have hex tokens, so this is a signed one or a replay marker
+	if isSignedChallenge(token) {
+		return nil, "", ErrChallengeNotFound
+	}
+
+	challengeData, err := c.store.GetChallenge(ctx, token)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load challenge: %w", err)
+	}
+	if challengeData == nil {
+		return nil, "", ErrChallengeNotFound
+	}
+	if challengeData.Expires < now {
+		if _, err := c.store.DeleteChallenge(ctx, token); err != nil {
+			return nil, "", fmt.Errorf("failed to delete challenge: %w", err)
+		}
+		return nil, "", ErrChallengeExpired
+	}
+
+	return challengeData, "", nil
+}
+
+// claimChallenge takes the challenge returned by peekChallenge, so it can't be
+// redeemed again. It returns ErrChallengeNotFound if a concurrent redeem took it first.
+func (c *Cap) claimChallenge(ctx context.Context, challengeData *ChallengeData, nonce string) error {
+	if nonce != "" {
+		if !c.replay.use(nonce, challengeData.Expires) {
+			return ErrChallengeNotFound
+		}
+		if !c.sharedReplay() {
+			return nil
+		}
+		deleted, err := c.store.DeleteChallenge(ctx, replayKey(nonce))
+		if err != nil {
+			return fmt.Errorf("failed to delete challenge nonce: %w", err)
+		}
+		if !deleted {
+			return ErrChallengeNotFound
+		}
+		return nil
+	}
+
+	deleted, err := c.store.DeleteChallenge(ctx, challengeData.Token)
+	if err != nil {
+		return fmt.Errorf("failed to delete challenge: %w", err)
+	}
+	if !deleted {
+		return ErrChallengeNotFound
+	}
+	return nil
 }
 
 // ValidateToken validates a verification token
 func (c *Cap) ValidateToken(token string, conf *TokenConfig) (*ValidationResponse, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return c.ValidateTokenContext(context.Background(), token, conf)
+}
 
-	c.cleanExpiredTokens()
+// ValidateTokenContext is like ValidateToken, giving up when ctx is done
+func (c *Cap) ValidateTokenContext(ctx context.Context, token string, conf *TokenConfig) (*ValidationResponse, error) {
+	resp, siteKey, err := c.validateToken(ctx, token, conf)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Hooks != nil && c.config.Hooks.OnValidate != nil {
+		c.config.Hooks.OnValidate(withSite(ctx, siteKey), resp)
+	}
+	return resp, nil
+}
 
+// validateToken does the work of ValidateTokenContext, also returning the
+// site the token was redeemed for
+func (c *Cap) validateToken(ctx context.Context, token string, conf *TokenConfig) (*ValidationResponse, string, error) {
+	if c.closed.Load() {
+		return nil, "", ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	c.maybeCleanExpired(ctx)
+
+	// The token is only spent once every check passes, so a caller scoped to
+	// another site or client can't burn it
+	signed := c.config.TokenKeyring != nil && isSignedToken(token)
+	var data *TokenData
+	var id string
+	var err error
+	if signed {
+		data, id, err = c.lookupSignedToken(ctx, token)
+	} else {
+		data, id, err = c.lookupStoredToken(ctx, token)
+	}
+	var reason *Error
+	if errors.As(err, &reason) {
+		return &ValidationResponse{Success: false, Code: reason.Code}, conf.siteKey(), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Tokens are scoped to the site they were redeemed for
+	if conf != nil && conf.SiteKey != "" && data.SiteKey != conf.SiteKey {
+		return &ValidationResponse{Success: false, Code: ErrSiteMismatch.Code}, data.SiteKey, nil
+	}
+	// and, when the caller expects one, to the action they were solved for
+	if conf != nil && conf.Action != "" && data.Action != conf.Action {
+		return &ValidationResponse{Success: false, Code: ErrActionMismatch.Code}, data.SiteKey, nil
+	}
+	if conf != nil && !data.Binding.matches(conf.Binding) {
+		return &ValidationResponse{Success: false, Code: ErrBindingMismatch.Code}, data.SiteKey, nil
+	}
+
+	if conf == nil || !conf.KeepToken {
+		err = c.spendToken(ctx, id, data, signed)
+		if errors.As(err, &reason) {
+			return &ValidationResponse{Success: false, Code: reason.Code}, data.SiteKey, nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return &ValidationResponse{
+		Success:  true,
+		IssuedAt: data.IssuedAt,
+		Hostname: data.Hostname,
+		Action:   data.Action,
+	}, data.SiteKey, nil
+}
+
+// lookupStoredToken looks up an id:vertoken token in the store without
+// consuming it, returning its data and store key. Consumed tokens leave a
+// tombstone in the store until they expire, so reuse can be told apart from
+// unknown tokens on every instance sharing it.
+func (c *Cap) lookupStoredToken(ctx context.Context, token string) (*TokenData, string, error) {
 	parts := strings.Split(token, ":")
-	if len(parts) != 2 {
-		return &ValidationResponse{Success: false}, nil
+	// Ids are hex, so a dot would address a tombstone
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], ".") {
+		return nil, "", ErrTokenMalformed
 	}
 
 	id, vertoken := parts[0], parts[1]
@@ -321,101 +891,202 @@ func (c *Cap) ValidateToken(token string, conf *TokenConfig) (*ValidationRespons
 	hashHex := hex.EncodeToString(hash[:])
 	key := fmt.Sprintf("%s:%s", id, hashHex)
 
-	if _, exists := c.config.State.TokensList[key]; exists {
-		if conf == nil || !conf.KeepToken {
-			delete(c.config.State.TokensList, key)
-		}
+	data, err := c.store.ConsumeToken(ctx, key, true)
+	if errors.Is(err, ErrTokenExpired) {
+		return nil, "", ErrTokenExpired
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to look up verification token: %w", err)
+	}
 
-		if !c.config.NoFSState {
-			if err := c.saveTokens(); err != nil {
-				// Log error but don't fail the operation
-				fmt.Printf("Warning: failed to save tokens: %v\n", err)
-			}
+	if data == nil {
+		tombstone, err := c.store.ConsumeToken(ctx, spentKey(key), true)
+		if errors.Is(err, ErrTokenExpired) {
+			return nil, "", ErrTokenExpired
 		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to look up spent token: %w", err)
+		}
+		if tombstone != nil {
+			return nil, "", ErrTokenReused
+		}
+		return nil, "", ErrTokenNotFound
+	}
+	return data, key, nil
+}
 
-		return &ValidationResponse{Success: true}, nil
+// lookupSignedToken verifies a signed verification token, returning its data
+// and nonce. Only a shared store is asked whether the nonce is unspent.
+func (c *Cap) lookupSignedToken(ctx context.Context, token string) (*TokenData, string, error) {
+	claims, err := c.config.TokenKeyring.verify(token)
+	if err != nil {
+		return nil, "", ErrTokenMalformed
+	}
+	if claims.Expires < time.Now().UnixMilli() {
+		return nil, "", ErrTokenExpired
+	}
+	if c.sharedReplay() {
+		unspent, err := c.store.ConsumeToken(ctx, tokenNonceKey(claims.Nonce), true)
+		if errors.Is(err, ErrTokenExpired) {
+			return nil, "", ErrTokenExpired
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to look up token nonce: %w", err)
+		}
+		if unspent == nil {
+			return nil, "", ErrTokenReused
+		}
+	} else if c.spent.contains(claims.Nonce) {
+		return nil, "", ErrTokenReused
 	}
 
-	return &ValidationResponse{Success: false}, nil
+	return &TokenData{
+		Expires:  claims.Expires,
+		IssuedAt: claims.IssuedAt,
+		Hostname: claims.Host,
+		SiteKey:  claims.Site,
+		Action:   claims.Action,
+		Binding:  claims.Binding,
+	}, claims.Nonce, nil
 }
 
-// Cleanup cleans up expired tokens and syncs state to disk
-func (c *Cap) Cleanup() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	tokensChanged := c.cleanExpiredTokens()
+// spendToken consumes the token looked up under id, returning ErrTokenReused
+// if a concurrent validation spent it first
+func (c *Cap) spendToken(ctx context.Context, id string, data *TokenData, signed bool) error {
+	if signed && c.sharedReplay() {
+		unspent, err := c.store.ConsumeToken(ctx, tokenNonceKey(id), false)
+		if errors.Is(err, ErrTokenExpired) {
+			return ErrTokenExpired
+		}
+		if err != nil {
+			return fmt.Errorf("failed to spend token nonce: %w", err)
+		}
+		if unspent == nil {
+			return ErrTokenReused
+		}
+		return nil
+	}
+	if signed {
+		if !c.spent.use(id, data.Expires) {
+			return ErrTokenReused
+		}
+		return nil
+	}
 
-	if tokensChanged && !c.config.NoFSState {
-		return c.saveTokens()
+	// The tombstone goes in first so a concurrent lookup never finds neither
+	if err := c.store.PutToken(ctx, spentKey(id), &TokenData{Expires: data.Expires}); err != nil {
+		return fmt.Errorf("failed to record spent token: %w", err)
 	}
 
+	consumed, err := c.store.ConsumeToken(ctx, id, false)
+	if errors.Is(err, ErrTokenExpired) {
+		return ErrTokenExpired
+	}
+	if err != nil {
+		return fmt.Errorf("failed to consume verification token: %w", err)
+	}
+	if consumed == nil {
+		return ErrTokenReused
+	}
 	return nil
 }
 
-// loadTokens loads tokens from the storage file
-func (c *Cap) loadTokens() {
-	dirPath := filepath.Dir(c.config.TokensStorePath)
-	if dirPath != "." {
-		if err := os.MkdirAll(dirPath, 0755); err != nil {
-			fmt.Printf("Warning: couldn't create tokens directory: %v\n", err)
-			return
-		}
+// spentKey is the key of the tombstone a consumed stored token leaves under
+// key. The dot keeps it from being taken for an id:vertoken token.
+func spentKey(key string) string {
+	return "spent." + key
+}
+
+// Cleanup cleans up expired tokens and syncs state to disk
+func (c *Cap) Cleanup() error {
+	return c.CleanupContext(context.Background())
+}
+
+// CleanupContext is like Cleanup, giving up when ctx is done
+func (c *Cap) CleanupContext(ctx context.Context) error {
+	if c.closed.Load() {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	data, err := os.ReadFile(c.config.TokensStorePath)
+	now := time.Now().UnixMilli()
+	c.replay.sweep(now)
+	c.spent.sweep(now)
+
+	tokensChanged, err := c.store.Sweep(ctx, now)
 	if err != nil {
-		// File doesn't exist, create empty one
-		fmt.Printf("[cap] Tokens file not found, creating a new empty one\n")
-		if err := os.WriteFile(c.config.TokensStorePath, []byte("{}"), 0644); err != nil {
-			fmt.Printf("Warning: couldn't create tokens file: %v\n", err)
-		}
-		c.config.State.TokensList = make(map[string]int64)
-		return
+		return fmt.Errorf("failed to sweep expired state: %w", err)
 	}
 
-	var tokensList map[string]int64
-	if err := json.Unmarshal(data, &tokensList); err != nil {
-		fmt.Printf("Warning: couldn't parse tokens file, using empty state: %v\n", err)
-		c.config.State.TokensList = make(map[string]int64)
-		return
+	// Outstanding challenges are persisted even when no token changed
+	if memory, ok := c.store.(*MemoryStore); ok && memory.pendingChallenges() {
+		tokensChanged = true
+	}
+	if tokensChanged {
+		return c.flush(ctx)
 	}
 
-	c.config.State.TokensList = tokensList
-	c.cleanExpiredTokens()
+	return nil
 }
 
-// saveTokens saves tokens to the storage file
+// saveTokens syncs the store to durable storage if it supports it
 func (c *Cap) saveTokens() error {
-	data, err := json.Marshal(c.config.State.TokensList)
-	if err != nil {
-		return fmt.Errorf("failed to marshal tokens: %w", err)
+	return c.flush(context.Background())
+}
+
+// flush syncs the store to durable storage if it supports it, giving up when ctx is done
+func (c *Cap) flush(ctx context.Context) error {
+	if f, ok := c.store.(Flusher); ok {
+		return f.Flush(ctx)
 	}
+	return nil
+}
 
-	return os.WriteFile(c.config.TokensStorePath, data, 0644)
+// maybeCleanExpired sweeps expired state on behalf of an API call, at most once
+// per inlineSweepIntervalMs so concurrent calls don't all contend on the store
+func (c *Cap) maybeCleanExpired(ctx context.Context) {
+	now := time.Now().UnixMilli()
+	last := c.lastSweep.Load()
+	if now-last < inlineSweepIntervalMs || !c.lastSweep.CompareAndSwap(last, now) {
+		return
+	}
+	c.sweepExpired(ctx)
 }
 
-// cleanExpiredTokens removes expired tokens and challenges from memory
+// cleanExpiredTokens removes expired tokens and challenges from the store
 func (c *Cap) cleanExpiredTokens() bool {
+	return c.sweepExpired(context.Background())
+}
+
+// sweepExpired removes expired tokens and challenges, logging failures with ctx
+func (c *Cap) sweepExpired(ctx context.Context) bool {
 	now := time.Now().UnixMilli()
-	tokensChanged := false
+	c.replay.sweep(now)
+	c.spent.sweep(now)
 
-	// Clean expired challenges
-	for k, v := range c.config.State.ChallengesList {
-		if v.Expires < now {
-			delete(c.config.State.ChallengesList, k)
-		}
+	tokensChanged, err := c.store.Sweep(ctx, now)
+	if err != nil && ctx.Err() == nil {
+		c.logf(ctx, "failed to sweep expired state: %v", err)
 	}
+	return tokensChanged
+}
 
-	// Clean expired tokens
-	for k, v := range c.config.State.TokensList {
-		if v < now {
-			delete(c.config.State.TokensList, k)
-			tokensChanged = true
-		}
+// siteKey returns the site the challenge is requested for, if any
+func (conf *ChallengeConfig) siteKey() string {
+	if conf == nil {
+		return ""
 	}
+	return conf.SiteKey
+}
 
-	return tokensChanged
+// siteKey returns the site the token must belong to, if any
+func (conf *TokenConfig) siteKey() string {
+	if conf == nil {
+		return ""
+	}
+	return conf.SiteKey
 }
 
 // generateRandomHex generates a random hex string of the specified length
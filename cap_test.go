@@ -1,11 +1,14 @@
 package capserver
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -323,6 +326,57 @@ func TestCleanup(t *testing.T) {
 	}
 }
 
+// solveChallenges solves SHA-256 prefix challenges as legacy [salt, target, nonce] tuples
+func solveChallenges(t testing.TB, challenges []ChallengeTuple) [][]interface{} {
+	t.Helper()
+	solutions := make([][]interface{}, len(challenges))
+	for i, nonce := range solveWith(t, SHA256(), challenges, false) {
+		n, _ := strconv.Atoi(nonce)
+		solutions[i] = []interface{}{challenges[i][0], challenges[i][1], n}
+	}
+	return solutions
+}
+
+func TestRedeemAndValidate(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true})
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{
+		ChallengeCount:      3,
+		ChallengeDifficulty: 2,
+		Store:               true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+
+	result, err := cap.RedeemChallenge(&Solution{
+		Token:     challenge.Token,
+		Solutions: solveChallenges(t, challenge.Challenge),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !result.Success || result.Token == "" {
+		t.Fatalf("Expected successful redeem, got %+v", result)
+	}
+
+	validation, err := cap.ValidateToken(result.Token, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !validation.Success {
+		t.Error("Expected token to validate")
+	}
+
+	validation, err = cap.ValidateToken(result.Token, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if validation.Success {
+		t.Error("Expected token to be single-use")
+	}
+}
+
 func BenchmarkCreateChallenge(b *testing.B) {
 	cap := New(&CapConfig{NoFSState: true})
 	config := &ChallengeConfig{
@@ -339,6 +393,137 @@ func BenchmarkCreateChallenge(b *testing.B) {
 	}
 }
 
+// BenchmarkCreateChallengeOutstanding measures CreateChallenge (including its
+// expiry sweep) with many unsolved challenges in the store
+func BenchmarkCreateChallengeOutstanding(b *testing.B) {
+	for _, outstanding := range []int{0, 10000, 1000000} {
+		b.Run(fmt.Sprintf("outstanding=%d", outstanding), func(b *testing.B) {
+			cap := New(&CapConfig{NoFSState: true})
+			ctx := context.Background()
+			data := &ChallengeData{Expires: time.Now().UnixMilli() + 3600000}
+			for i := 0; i < outstanding; i++ {
+				if err := cap.store.PutChallenge(ctx, strconv.Itoa(i), data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			config := &ChallengeConfig{ChallengeCount: 1, Store: true}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := cap.CreateChallenge(config); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSweepExpired measures a sweep that removes a fixed number of
+// expired challenges from a store holding many live ones
+func BenchmarkSweepExpired(b *testing.B) {
+	store := NewMemoryStore(nil, "")
+	ctx := context.Background()
+	now := time.Now().UnixMilli()
+	live := &ChallengeData{Expires: now + 3600000}
+	for i := 0; i < 1000000; i++ {
+		store.PutChallenge(ctx, strconv.Itoa(i), live)
+	}
+	expired := &ChallengeData{Expires: now - 1}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 100; j++ {
+			store.PutChallenge(ctx, "expired"+strconv.Itoa(j), expired)
+		}
+		b.StartTimer()
+
+		if _, err := store.Sweep(ctx, now); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCreateChallengeParallel(b *testing.B) {
+	for _, shards := range []int{1, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cap := New(&CapConfig{NoFSState: true, StoreShards: shards})
+			config := &ChallengeConfig{ChallengeCount: 50, Store: true}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := cap.CreateChallenge(config); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkRedeemChallengeParallel(b *testing.B) {
+	for _, shards := range []int{1, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cap := New(&CapConfig{NoFSState: true, StoreShards: shards})
+			solutions := make([]*Solution, b.N)
+			for i := range solutions {
+				challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 10, ChallengeDifficulty: 2, Store: true})
+				if err != nil {
+					b.Fatal(err)
+				}
+				solutions[i] = &Solution{Token: challenge.Token, Solutions: solveChallenges(b, challenge.Challenge)}
+			}
+			var next atomic.Int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					result, err := cap.RedeemChallenge(solutions[next.Add(1)-1])
+					if err != nil || !result.Success {
+						b.Errorf("redeem failed: %v %+v", err, result)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkValidateTokenParallel(b *testing.B) {
+	for _, shards := range []int{1, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cap := New(&CapConfig{NoFSState: true, StoreShards: shards})
+			tokens := make([]string, 1000)
+			for i := range tokens {
+				challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true})
+				if err != nil {
+					b.Fatal(err)
+				}
+				result, err := cap.RedeemChallenge(&Solution{Token: challenge.Token, Solutions: solveChallenges(b, challenge.Challenge)})
+				if err != nil || !result.Success {
+					b.Fatalf("redeem failed: %v %+v", err, result)
+				}
+				tokens[i] = result.Token
+			}
+			config := &TokenConfig{KeepToken: true}
+			var next atomic.Int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					token := tokens[next.Add(1)%int64(len(tokens))]
+					if result, err := cap.ValidateToken(token, config); err != nil || !result.Success {
+						b.Errorf("validate failed: %v %+v", err, result)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
 func BenchmarkGenerateRandomHex(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
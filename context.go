@@ -0,0 +1,68 @@
+package capserver
+
+import (
+	"context"
+	"fmt"
+)
+
+// RequestInfo describes the client request a Cap operation is made for. Attach
+// it with WithRequestInfo; Cap fills in SiteKey once it knows the site.
+type RequestInfo struct {
+	SiteKey   string // Site the request is for
+	ClientIP  string // Address of the client
+	UserAgent string // User-Agent header of the client
+	Path      string // Path the request was made to
+
+	Labels map[string]string // Custom labels for the DifficultyPolicy and hooks, e.g. the client's ASN or reputation
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a copy of ctx carrying info
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the RequestInfo attached to ctx, or nil if there is none
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// withSite returns ctx with the site recorded in its RequestInfo, leaving the caller's copy untouched
+func withSite(ctx context.Context, siteKey string) context.Context {
+	if siteKey == "" {
+		return ctx
+	}
+
+	info := RequestInfo{SiteKey: siteKey}
+	if existing := RequestInfoFromContext(ctx); existing != nil {
+		if existing.SiteKey == siteKey {
+			return ctx
+		}
+		info = *existing
+		info.SiteKey = siteKey
+	}
+	return WithRequestInfo(ctx, &info)
+}
+
+// Hooks are called with the request context after each successful Cap operation.
+// Hooks run synchronously, so they should return quickly.
+type Hooks struct {
+	OnChallenge func(ctx context.Context, resp *ChallengeResponse)  // Called after a challenge is created
+	OnRedeem    func(ctx context.Context, resp *RedeemResponse)     // Called after a solution is checked, whether or not it was accepted
+	OnValidate  func(ctx context.Context, resp *ValidationResponse) // Called after a token is checked, whether or not it was accepted
+}
+
+// Logger receives warnings from Cap. ctx carries the RequestInfo of the
+// operation that caused the warning, if any.
+type Logger func(ctx context.Context, format string, args ...interface{})
+
+// logf reports a warning through the configured Logger, or prints it
+func (c *Cap) logf(ctx context.Context, format string, args ...interface{}) {
+	if c.config.Logger != nil {
+		c.config.Logger(ctx, format, args...)
+		return
+	}
+	fmt.Printf("Warning: "+format+"\n", args...)
+}
@@ -0,0 +1,200 @@
+package capserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestContextCancellation(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true})
+	defer cap.Close()
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, ChallengeSize: 8, ChallengeDifficulty: 1, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := cap.CreateChallengeContext(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from CreateChallengeContext, got %v", err)
+	}
+	solution := &Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)}
+	if _, err := cap.RedeemChallengeContext(ctx, solution); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from RedeemChallengeContext, got %v", err)
+	}
+	if _, err := cap.ValidateTokenContext(ctx, "id:token", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from ValidateTokenContext, got %v", err)
+	}
+	if err := cap.CleanupContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from CleanupContext, got %v", err)
+	}
+
+	// A call cancelled before it started leaves the challenge redeemable
+	resp, err := cap.RedeemChallengeContext(context.Background(), solution)
+	if err != nil || !resp.Success {
+		t.Errorf("Expected redeem to succeed after cancelled attempt, got %+v, %v", resp, err)
+	}
+}
+
+func TestHooksReceiveRequestInfo(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]*RequestInfo)
+	record := func(event string) func(ctx context.Context) {
+		return func(ctx context.Context) {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[event] = RequestInfoFromContext(ctx)
+		}
+	}
+	onChallenge, onRedeem, onValidate := record("challenge"), record("redeem"), record("validate")
+
+	cap := New(&CapConfig{
+		NoFSState: true,
+		Sites:     []*Site{{Key: "site-a", ChallengeCount: 2, ChallengeDifficulty: 1}},
+		Hooks: &Hooks{
+			OnChallenge: func(ctx context.Context, resp *ChallengeResponse) { onChallenge(ctx) },
+			OnRedeem:    func(ctx context.Context, resp *RedeemResponse) { onRedeem(ctx) },
+			OnValidate:  func(ctx context.Context, resp *ValidationResponse) { onValidate(ctx) },
+		},
+	})
+	defer cap.Close()
+
+	h := NewHandler(cap, &HandlerOptions{
+		ChallengeConfig: func(r *http.Request) *ChallengeConfig {
+			return &ChallengeConfig{SiteKey: "site-a", Store: true}
+		},
+		ClientIP: func(r *http.Request) string { return "203.0.113.7" },
+	})
+	token := redeemThroughHandler(t, h, "https://example.com")
+
+	body, _ := json.Marshal(map[string]string{"token": token})
+	postJSON(t, h, "/validate", string(body), nil)
+
+	for _, event := range []string{"challenge", "redeem", "validate"} {
+		info := seen[event]
+		if info == nil {
+			t.Errorf("%s: expected hook to receive request info", event)
+			continue
+		}
+		if info.SiteKey != "site-a" || info.ClientIP != "203.0.113.7" || info.Path != "/"+event {
+			t.Errorf("%s: unexpected request info %+v", event, info)
+		}
+	}
+}
+
+func TestWithSiteKeepsCallerInfo(t *testing.T) {
+	info := &RequestInfo{ClientIP: "192.0.2.1"}
+	ctx := withSite(WithRequestInfo(context.Background(), info), "site-a")
+
+	got := RequestInfoFromContext(ctx)
+	if got.SiteKey != "site-a" || got.ClientIP != "192.0.2.1" {
+		t.Errorf("Expected site to be added to request info, got %+v", got)
+	}
+	if info.SiteKey != "" {
+		t.Error("Expected the caller's request info to be left untouched")
+	}
+}
+
+// failingStore is a MemoryStore whose sweeps fail
+type failingStore struct {
+	*MemoryStore
+}
+
+func (s failingStore) Sweep(ctx context.Context, now int64) (bool, error) {
+	return false, errors.New("sweep failed")
+}
+
+func TestLoggerReceivesContext(t *testing.T) {
+	var logged []string
+	cap := New(&CapConfig{
+		Store: failingStore{NewMemoryStore(nil, "")},
+		Logger: func(ctx context.Context, format string, args ...interface{}) {
+			msg := fmt.Sprintf(format, args...)
+			if info := RequestInfoFromContext(ctx); info != nil {
+				msg = info.ClientIP + " " + msg
+			}
+			logged = append(logged, msg)
+		},
+	})
+	defer cap.Close()
+
+	ctx := WithRequestInfo(context.Background(), &RequestInfo{ClientIP: "198.51.100.2"})
+	if _, err := cap.CreateChallengeContext(ctx, nil); err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+
+	if len(logged) != 1 || !strings.HasPrefix(logged[0], "198.51.100.2 failed to sweep") {
+		t.Errorf("Expected sweep failure to be logged with request info, got %q", logged)
+	}
+}
+
+func TestLoggerReceivesStoreWarnings(t *testing.T) {
+	var logged []string
+	dir := t.TempDir()
+	cap := New(&CapConfig{
+		TokensStorePath: filepath.Join(dir, "tokens", "tokens.json"),
+		Logger: func(ctx context.Context, format string, args ...interface{}) {
+			msg := fmt.Sprintf(format, args...)
+			if info := RequestInfoFromContext(ctx); info != nil {
+				msg = info.ClientIP + " " + msg
+			}
+			logged = append(logged, msg)
+		},
+	})
+	defer cap.Close()
+
+	// Saving fails once the tokens directory is gone
+	os.RemoveAll(filepath.Join(dir, "tokens"))
+	ctx := WithRequestInfo(context.Background(), &RequestInfo{ClientIP: "198.51.100.3"})
+	challenge, _ := cap.CreateChallengeContext(ctx, &ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true})
+	cap.RedeemChallengeContext(ctx, &Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)})
+
+	if len(logged) == 0 || !strings.HasPrefix(logged[0], "198.51.100.3 failed to save tokens") {
+		t.Errorf("Expected the store's warning to be logged with request info, got %q", logged)
+	}
+}
+
+func TestRedisStoreHonorsContext(t *testing.T) {
+	// A server that accepts connections but never replies
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	store := NewRedisStore(RedisOptions{Addr: ln.Addr().String()})
+	defer store.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := store.GetChallenge(ctx, "token"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := store.ConsumeToken(ctx, "key", false); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
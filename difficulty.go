@@ -0,0 +1,64 @@
+package capserver
+
+import (
+	"crypto/sha256"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDifficultyBits is the most leading zero bits a hash can have
+const maxDifficultyBits = 8 * sha256.Size
+
+// DefaultHashesPerSecond is a rough hash rate of a browser solving challenges,
+// used by EstimateWork when no rate is given
+const DefaultHashesPerSecond = 1000000
+
+// bitsThreshold returns the target for bits leading zero bits: the largest
+// ceil(bits/4)-character hex prefix a hash with that many zero bits can have
+func bitsThreshold(bits int) string {
+	if bits <= 0 {
+		return ""
+	}
+	n := (bits + 3) / 4
+	return strings.Repeat("0", n-1) + strconv.FormatInt(1<<(4*n-bits)-1, 16)
+}
+
+// WorkEstimate is the expected cost of solving a challenge
+type WorkEstimate struct {
+	HashesPerChallenge float64       // Expected hashes to solve one of the challenges
+	Hashes             float64       // Expected hashes to solve all of them
+	SolveTime          time.Duration // Expected time to solve all of them at the given hash rate
+}
+
+// EstimateWork returns the expected cost of solving a challenge created with
+// conf by a client computing hashesPerSecond hashes of the challenge's
+// algorithm (default: DefaultHashesPerSecond, a SHA-256 rate)
+func (c *Cap) EstimateWork(conf *ChallengeConfig, hashesPerSecond float64) (*WorkEstimate, error) {
+	params, err := c.challengeParams(conf)
+	if err != nil {
+		return nil, err
+	}
+	if hashesPerSecond <= 0 {
+		hashesPerSecond = DefaultHashesPerSecond
+	}
+
+	// A random target of n hex characters matches one hash in 16^n
+	perChallenge := math.Pow(16, float64(params.difficulty))
+	if params.bits > 0 {
+		perChallenge = math.Exp2(float64(params.bits))
+	}
+	hashes := perChallenge * float64(params.count)
+
+	solveTime := time.Duration(math.MaxInt64)
+	if seconds := hashes / hashesPerSecond; seconds < float64(math.MaxInt64)/float64(time.Second) {
+		solveTime = time.Duration(seconds * float64(time.Second))
+	}
+
+	return &WorkEstimate{
+		HashesPerChallenge: perChallenge,
+		Hashes:             hashes,
+		SolveTime:          solveTime,
+	}, nil
+}
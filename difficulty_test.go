@@ -0,0 +1,138 @@
+package capserver
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// leadingZeroBits counts the leading zero bits of the hash of salt+nonce
+func leadingZeroBits(salt, nonce string) int {
+	hash := sha256.Sum256([]byte(salt + nonce))
+	n := 0
+	for _, b := range hash {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+func TestBitsThreshold(t *testing.T) {
+	for b, want := range map[int]string{0: "", 1: "7", 3: "1", 4: "0", 5: "07", 8: "00", 10: "003", 256: strings.Repeat("0", 64)} {
+		if got := bitsThreshold(b); got != want {
+			t.Errorf("bitsThreshold(%d) = %q, want %q", b, got, want)
+		}
+	}
+
+	// The threshold passes exactly the hashes with enough leading zero bits
+	for b := 1; b <= 12; b++ {
+		threshold := bitsThreshold(b)
+		for n := 0; n < 2000; n++ {
+			nonce := strconv.Itoa(n)
+			if got, want := checkNonceThreshold("salt", threshold, nonce), leadingZeroBits("salt", nonce) >= b; got != want {
+				t.Fatalf("%d bits, nonce %s: threshold check %v, want %v", b, nonce, got, want)
+			}
+		}
+	}
+}
+
+func TestDifficultyBits(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true, ChallengeSecret: "secret"})
+	defer cap.Close()
+
+	for _, conf := range []*ChallengeConfig{
+		{ChallengeCount: 3, DifficultyBits: 6, Store: true},
+		{ChallengeCount: 3, DifficultyBits: 6, Store: false},
+		{ChallengeCount: 3, DifficultyBits: 6, Store: false, Seeded: true},
+	} {
+		challenge, err := cap.CreateChallenge(conf)
+		if err != nil {
+			t.Fatalf("Failed to create challenge: %v", err)
+		}
+		if challenge.Bits != 6 || challenge.Challenges()[0][1] != "03" {
+			t.Fatalf("Expected 6-bit threshold targets, got %+v", challenge)
+		}
+
+		nonces := solveWith(t, SHA256(), challenge.Challenges(), true)
+		for i, ch := range challenge.Challenges() {
+			if leadingZeroBits(ch[0], nonces[i]) < 6 {
+				t.Fatalf("Solver returned a nonce without 6 zero bits")
+			}
+		}
+
+		resp, err := cap.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: nonces})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !resp.Success {
+			t.Errorf("%+v: expected redeem to succeed, got %+v", conf, resp)
+		}
+	}
+
+	// A nonce failing the threshold is rejected
+	challenge, _ := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, DifficultyBits: 8, Store: true})
+	salt := challenge.Challenge[0][0]
+	var nonce string
+	for n := 0; ; n++ {
+		if nonce = strconv.Itoa(n); leadingZeroBits(salt, nonce) < 8 {
+			break
+		}
+	}
+	resp, _ := cap.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: []string{nonce}})
+	if resp.Success || resp.Code != ErrSolutionInvalid.Code {
+		t.Errorf("Expected a nonce with too few zero bits to be rejected, got %+v", resp)
+	}
+
+	if _, err := cap.CreateChallenge(&ChallengeConfig{DifficultyBits: 257, Store: true}); err == nil {
+		t.Error("Expected more bits than the hash has to be refused")
+	}
+}
+
+func TestDifficultyModePrecedence(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true, Sites: []*Site{{Key: "bits", DifficultyBits: 10}}})
+	defer cap.Close()
+
+	site, _ := cap.CreateChallenge(&ChallengeConfig{SiteKey: "bits", ChallengeCount: 1, Store: true})
+	if site.Bits != 10 || site.Challenge[0][1] != "003" {
+		t.Errorf("Expected the site's bit difficulty, got %+v", site)
+	}
+
+	prefix, _ := cap.CreateChallenge(&ChallengeConfig{SiteKey: "bits", ChallengeCount: 1, ChallengeDifficulty: 2, Store: true})
+	if prefix.Bits != 0 || len(prefix.Challenge[0][1]) != 2 {
+		t.Errorf("Expected a prefix difficulty in the config to override the site's bits, got %+v", prefix)
+	}
+}
+
+func TestEstimateWork(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true})
+	defer cap.Close()
+
+	tests := []struct {
+		conf            *ChallengeConfig
+		hashesPerSecond float64
+		perChallenge    float64
+		solveTime       time.Duration
+	}{
+		{nil, 0, 65536, 3276800 * time.Microsecond},
+		{&ChallengeConfig{ChallengeCount: 10, ChallengeDifficulty: 2}, 256, 256, 10 * time.Second},
+		{&ChallengeConfig{ChallengeCount: 10, DifficultyBits: 10}, 1024, 1024, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		estimate, err := cap.EstimateWork(tt.conf, tt.hashesPerSecond)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if estimate.HashesPerChallenge != tt.perChallenge || estimate.SolveTime != tt.solveTime {
+			t.Errorf("%+v: expected %v hashes per challenge in %v, got %+v", tt.conf, tt.perChallenge, tt.solveTime, estimate)
+		}
+	}
+
+	if _, err := cap.EstimateWork(&ChallengeConfig{SiteKey: "missing"}, 0); err == nil {
+		t.Error("Expected an error for an unknown site")
+	}
+}
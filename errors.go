@@ -0,0 +1,61 @@
+package capserver
+
+// Error is the reason a challenge or token was rejected. Its Code is stable
+// and sent to clients in the Code field of RedeemResponse and ValidationResponse.
+type Error struct {
+	Code    string
+	message string
+}
+
+func (e *Error) Error() string {
+	return e.message
+}
+
+// Reasons a solution is rejected by RedeemChallenge
+var (
+	ErrChallengeNotFound = &Error{Code: "challenge_not_found", message: "challenge not found or already redeemed"}
+	ErrChallengeExpired  = &Error{Code: "challenge_expired", message: "challenge expired"}
+	ErrSolutionMissing   = &Error{Code: "solution_missing", message: "solution missing"}
+	ErrSolutionInvalid   = &Error{Code: "solution_invalid", message: "solution invalid"}
+)
+
+// Reasons a token is rejected by ValidateToken
+var (
+	ErrTokenNotFound   = &Error{Code: "token_not_found", message: "token not found"}
+	ErrTokenExpired    = &Error{Code: "token_expired", message: "token expired"}
+	ErrTokenReused     = &Error{Code: "token_reused", message: "token already used"}
+	ErrTokenMalformed  = &Error{Code: "token_malformed", message: "token malformed"}
+	ErrSiteMismatch    = &Error{Code: "site_mismatch", message: "token was issued for another site"}
+	ErrBindingMismatch = &Error{Code: "binding_mismatch", message: "token is bound to another client"}
+	ErrActionMismatch  = &Error{Code: "action_mismatch", message: "token was solved for another action"}
+)
+
+var errorsByCode = map[string]*Error{}
+
+func init() {
+	for _, err := range []*Error{
+		ErrChallengeNotFound, ErrChallengeExpired, ErrSolutionMissing, ErrSolutionInvalid,
+		ErrTokenNotFound, ErrTokenExpired, ErrTokenReused, ErrTokenMalformed, ErrSiteMismatch,
+		ErrBindingMismatch, ErrActionMismatch,
+	} {
+		errorsByCode[err.Code] = err
+	}
+}
+
+// ErrorForCode returns the sentinel error with the given code, or nil if there is none
+func ErrorForCode(code string) error {
+	if err, exists := errorsByCode[code]; exists {
+		return err
+	}
+	return nil
+}
+
+// Err returns the reason the solution was rejected, or nil if it was accepted
+func (r *RedeemResponse) Err() error {
+	return ErrorForCode(r.Code)
+}
+
+// Err returns the reason the token was rejected, or nil if it was accepted
+func (r *ValidationResponse) Err() error {
+	return ErrorForCode(r.Code)
+}
@@ -0,0 +1,152 @@
+package capserver
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRedeemErrorCodes(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true, ChallengeSecret: "secret"})
+	defer cap.Close()
+
+	create := func(expiresMs int, store bool) *ChallengeResponse {
+		challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, ChallengeSize: 8, ChallengeDifficulty: 1, ExpiresMs: expiresMs, Store: store})
+		if err != nil {
+			t.Fatalf("Failed to create challenge: %v", err)
+		}
+		return challenge
+	}
+
+	redeemed := create(0, true)
+	cap.RedeemChallenge(&Solution{Token: redeemed.Token, Solutions: solveChallenges(t, redeemed.Challenge)})
+	expired := create(1, true)
+	expiredSigned := create(1, false)
+	time.Sleep(5 * time.Millisecond)
+
+	partial := create(0, true)
+	wrong := create(0, true)
+	wrongSolutions := solveChallenges(t, wrong.Challenge)
+	wrongSolutions[1][2] = failingNonce(wrong.Challenge[1][0], wrong.Challenge[1][1])
+
+	tests := []struct {
+		name     string
+		solution *Solution
+		want     error
+	}{
+		{"missing body", &Solution{Token: "token"}, ErrSolutionMissing},
+		{"missing token", &Solution{Solutions: [][]interface{}{}}, ErrChallengeNotFound},
+		{"unknown challenge", &Solution{Token: "unknown", Solutions: [][]interface{}{}}, ErrChallengeNotFound},
+		{"redeemed challenge", &Solution{Token: redeemed.Token, Solutions: solveChallenges(t, redeemed.Challenge)}, ErrChallengeNotFound},
+		{"tampered signed challenge", &Solution{Token: expiredSigned.Token + "x", Solutions: [][]interface{}{}}, ErrChallengeNotFound},
+		{"expired challenge", &Solution{Token: expired.Token, Solutions: solveChallenges(t, expired.Challenge)}, ErrChallengeExpired},
+		{"expired signed challenge", &Solution{Token: expiredSigned.Token, Solutions: [][]interface{}{}}, ErrChallengeExpired},
+		{"partial solution", &Solution{Token: partial.Token, Solutions: solveChallenges(t, partial.Challenge)[:1]}, ErrSolutionMissing},
+		{"wrong solution", &Solution{Token: wrong.Token, Solutions: wrongSolutions}, ErrSolutionInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cap.RedeemChallenge(tt.solution)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.Success || !errors.Is(resp.Err(), tt.want) {
+				t.Errorf("Expected %v, got code %q", tt.want, resp.Code)
+			}
+		})
+	}
+}
+
+func TestValidateErrorCodes(t *testing.T) {
+	keyring, err := NewKeyring(&SigningKey{ID: "k1", Algorithm: AlgHS256, Secret: []byte("secret-1")})
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config *CapConfig
+	}{
+		{"stored", &CapConfig{NoFSState: true}},
+		{"signed", &CapConfig{NoFSState: true, TokenKeyring: keyring}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cap := New(tc.config)
+			defer cap.Close()
+
+			expect := func(token string, conf *TokenConfig, want error) {
+				t.Helper()
+				resp, err := cap.ValidateToken(token, conf)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if resp.Success || !errors.Is(resp.Err(), want) {
+					t.Errorf("Expected %v, got code %q", want, resp.Code)
+				}
+			}
+
+			token := redeemSigned(t, cap)
+			expect(token, &TokenConfig{SiteKey: "other"}, ErrSiteMismatch)
+			// A mismatch leaves the token to its own site
+			if resp, _ := cap.ValidateToken(token, nil); !resp.Success {
+				t.Errorf("Expected the token to survive a mismatch, got %+v", resp)
+			}
+			expect(token, nil, ErrTokenReused)
+
+			expect("garbage", nil, ErrTokenMalformed)
+			expect("a.b.c", nil, ErrTokenMalformed)
+
+			success, _ := cap.ValidateToken(redeemSigned(t, cap), nil)
+			if !success.Success || success.Code != "" || success.Err() != nil {
+				t.Errorf("Expected success without a code, got %+v", success)
+			}
+		})
+	}
+
+	// Stored tokens that were never issued, or expired while still stored
+	cap := New(&CapConfig{NoFSState: true})
+	defer cap.Close()
+
+	resp, _ := cap.ValidateToken("0123456789abcdef:0123456789abcdef", nil)
+	if !errors.Is(resp.Err(), ErrTokenNotFound) {
+		t.Errorf("Expected ErrTokenNotFound, got code %q", resp.Code)
+	}
+
+	token := redeemSigned(t, cap)
+	for k := range cap.config.State.TokensList {
+		cap.config.State.TokensList[k] = time.Now().UnixMilli() - 1
+	}
+	resp, _ = cap.ValidateToken(token, nil)
+	if !errors.Is(resp.Err(), ErrTokenExpired) {
+		t.Errorf("Expected ErrTokenExpired, got code %q", resp.Code)
+	}
+}
+
+func TestTokenReusedAcrossInstances(t *testing.T) {
+	store := NewMemoryStore(nil, "")
+	issuer := New(&CapConfig{Store: store})
+	defer issuer.Close()
+	replica := New(&CapConfig{Store: store})
+	defer replica.Close()
+
+	token := redeemSigned(t, issuer)
+	if resp, _ := issuer.ValidateToken(token, nil); !resp.Success {
+		t.Fatalf("Expected the token to validate, got %+v", resp)
+	}
+	if resp, _ := replica.ValidateToken(token, nil); !errors.Is(resp.Err(), ErrTokenReused) {
+		t.Errorf("Expected reuse on a replica sharing the store to be reported, got code %q", resp.Code)
+	}
+	// The tombstone itself isn't a token
+	if resp, _ := replica.ValidateToken("spent."+token, nil); resp.Success || !errors.Is(resp.Err(), ErrTokenMalformed) {
+		t.Errorf("Expected the tombstone to be refused, got %+v", resp)
+	}
+}
+
+func TestErrorForCode(t *testing.T) {
+	if err := ErrorForCode("token_reused"); err != ErrTokenReused {
+		t.Errorf("Expected ErrTokenReused, got %v", err)
+	}
+	if err := ErrorForCode(""); err != nil {
+		t.Errorf("Expected nil for an empty code, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package capserver
+
+import "container/heap"
+
+// expiryEntry is a challenge or token scheduled to expire
+type expiryEntry struct {
+	expires   int64
+	key       string
+	challenge bool
+}
+
+// expiryHeap is a min-heap of entries ordered by expiry time. Entries are
+// removed lazily: deleting a challenge or token leaves its entry in the heap,
+// and the sweep skips entries that no longer match the stored expiry.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expires < h[j].expires }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	*h = old[:n-1]
+	return entry
+}
+
+// schedule adds an entry to the heap
+func (h *expiryHeap) schedule(key string, expires int64, challenge bool) {
+	heap.Push(h, expiryEntry{expires: expires, key: key, challenge: challenge})
+}
+
+// popExpired removes and returns the earliest entry if it expired before now
+func (h *expiryHeap) popExpired(now int64) (expiryEntry, bool) {
+	if len(*h) == 0 || (*h)[0].expires >= now {
+		return expiryEntry{}, false
+	}
+	return heap.Pop(h).(expiryEntry), true
+}
@@ -0,0 +1,410 @@
+package capserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultMaxBodyBytes is the default request body limit for the HTTP handler
+const DefaultMaxBodyBytes = 1 << 20 // 1 MiB
+
+// HandlerOptions contains configuration options for the HTTP handler
+type HandlerOptions struct {
+	Prefix            string                                 // Path prefix the endpoints are mounted under (default: "")
+	ChallengeConfig   func(r *http.Request) *ChallengeConfig // Per-request challenge configuration (default: nil, Cap defaults)
+	TokenConfig       func(r *http.Request) *TokenConfig     // Per-request token validation configuration (default: nil)
+	MaxBodyBytes      int64                                  // Maximum request body size (default: DefaultMaxBodyBytes)
+	SiteverifySecrets []string                               // Secrets accepted by {prefix}/siteverify besides site secrets (default: none)
+	SiteKeyInPath     bool                                   // Serve {prefix}/{siteKey}/challenge etc. for the Cap's sites (default: false)
+	ClientIP          func(r *http.Request) string           // Client address recorded in the RequestInfo passed to hooks (default: the connection's remote address)
+	RequestLabels     func(*http.Request) map[string]string  // Custom labels recorded in the RequestInfo (default: none)
+	TokenBinding      func(r *http.Request) *TokenBinding    // Client binding recorded with tokens redeemed through the handler (default: nil, unbound)
+}
+
+// ErrorResponse is the JSON body returned when a request can't be processed
+type ErrorResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
+// SiteverifyResponse is the reCAPTCHA/hCaptcha/Turnstile compatible siteverify response
+type SiteverifyResponse struct {
+	Success     bool     `json:"success"`
+	ChallengeTS string   `json:"challenge_ts,omitempty"` // ISO 8601 time the challenge was solved
+	Hostname    string   `json:"hostname,omitempty"`     // Hostname of the site the challenge was solved on
+	Action      string   `json:"action,omitempty"`       // Action the challenge was solved for
+	ErrorCodes  []string `json:"error-codes,omitempty"`
+}
+
+// Siteverify error codes, matching the reCAPTCHA API
+const (
+	SiteverifyMissingSecret   = "missing-input-secret"
+	SiteverifyInvalidSecret   = "invalid-input-secret"
+	SiteverifyMissingResponse = "missing-input-response"
+	SiteverifyInvalidResponse = "invalid-input-response"
+	SiteverifyBadRequest      = "bad-request"
+
+	SiteverifyTimeoutOrDuplicate = "timeout-or-duplicate" // Token expired or was already used
+)
+
+// handler serves the challenge, redeem and validate endpoints
+type handler struct {
+	cap  *Cap
+	opts HandlerOptions
+}
+
+// NewHandler returns an http.Handler serving POST {prefix}/challenge, {prefix}/redeem
+// and {prefix}/validate with the JSON wire format used by the Cap widget, plus
+// {prefix}/siteverify when SiteverifySecrets or sites are configured. With
+// SiteKeyInPath the widget endpoints move under {prefix}/{siteKey}/.
+func NewHandler(cap *Cap, opts *HandlerOptions) http.Handler {
+	h := &handler{cap: cap}
+	if opts != nil {
+		h.opts = *opts
+	}
+	h.opts.Prefix = strings.TrimSuffix(h.opts.Prefix, "/")
+	if h.opts.MaxBodyBytes <= 0 {
+		h.opts.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return h
+}
+
+// ServeHTTP dispatches to the endpoint matching the request path
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if h.opts.Prefix != "" {
+		if !strings.HasPrefix(path, h.opts.Prefix+"/") {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		path = strings.TrimPrefix(path, h.opts.Prefix)
+	}
+
+	var site *Site
+	if h.opts.SiteKeyInPath && path != "/siteverify" {
+		siteKey, endpoint, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		if !ok || siteKey == "" {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		if site = h.cap.Site(siteKey); site == nil {
+			writeError(w, http.StatusNotFound, "Unknown site")
+			return
+		}
+		path = "/" + endpoint
+	}
+
+	var serve func(http.ResponseWriter, *http.Request, *Site)
+	switch path {
+	case "/challenge":
+		serve = h.serveChallenge
+	case "/redeem":
+		serve = h.serveRedeem
+	case "/validate":
+		serve = h.serveValidate
+	case "/siteverify":
+		if len(h.opts.SiteverifySecrets) == 0 && len(h.cap.Sites()) == 0 {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		serve = h.serveSiteverify
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if site != nil && path != "/validate" && !site.AllowsOrigin(r.Header.Get("Origin")) {
+		writeError(w, http.StatusForbidden, "Origin not allowed")
+		return
+	}
+
+	info := &RequestInfo{
+		ClientIP:  h.clientIP(r),
+		UserAgent: r.UserAgent(),
+		Path:      r.URL.Path,
+	}
+	if h.opts.RequestLabels != nil {
+		info.Labels = h.opts.RequestLabels(r)
+	}
+	if site != nil {
+		info.SiteKey = site.Key
+	}
+	serve(w, r.WithContext(WithRequestInfo(r.Context(), info)), site)
+}
+
+// serveChallenge creates a new challenge
+func (h *handler) serveChallenge(w http.ResponseWriter, r *http.Request, site *Site) {
+	var config *ChallengeConfig
+	if h.opts.ChallengeConfig != nil {
+		config = h.opts.ChallengeConfig(r)
+	}
+	if site != nil {
+		siteConfig := ChallengeConfig{Store: true}
+		if config != nil {
+			siteConfig = *config
+		}
+		siteConfig.SiteKey = site.Key
+		config = &siteConfig
+	}
+
+	challenge, err := h.cap.CreateChallengeContext(r.Context(), config)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create challenge")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, challenge)
+}
+
+// serveRedeem checks a solution and returns a verification token
+func (h *handler) serveRedeem(w http.ResponseWriter, r *http.Request, site *Site) {
+	var solution Solution
+	if !h.decodeBody(w, r, &solution) {
+		return
+	}
+
+	if solution.Token == "" {
+		writeError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+	if solution.empty() {
+		writeError(w, http.StatusBadRequest, "Solutions are required")
+		return
+	}
+
+	solution.Hostname = requestHostname(r)
+	if h.opts.TokenBinding != nil {
+		solution.Binding = h.opts.TokenBinding(r)
+	}
+
+	result, err := h.cap.RedeemChallengeContext(r.Context(), &solution)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to redeem challenge")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// serveValidate checks a verification token
+func (h *handler) serveValidate(w http.ResponseWriter, r *http.Request, site *Site) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if !h.decodeBody(w, r, &req) {
+		return
+	}
+
+	if req.Token == "" {
+		writeError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	result, err := h.cap.ValidateTokenContext(r.Context(), req.Token, h.tokenConfig(r, site))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to validate token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// serveSiteverify validates a token submitted by a backend in the reCAPTCHA
+// siteverify shape, as form fields or JSON. A remoteip is checked against the
+// network the token is bound to.
+func (h *handler) serveSiteverify(w http.ResponseWriter, r *http.Request, _ *Site) {
+	var req struct {
+		Secret   string `json:"secret"`
+		Response string `json:"response"`
+		RemoteIP string `json:"remoteip"`
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		body := http.MaxBytesReader(w, r.Body, h.opts.MaxBodyBytes)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			writeSiteverifyError(w, SiteverifyBadRequest)
+			return
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, h.opts.MaxBodyBytes)
+		if err := r.ParseForm(); err != nil {
+			writeSiteverifyError(w, SiteverifyBadRequest)
+			return
+		}
+		req.Secret = r.PostForm.Get("secret")
+		req.Response = r.PostForm.Get("response")
+		req.RemoteIP = r.PostForm.Get("remoteip")
+	}
+
+	if req.Secret == "" {
+		writeSiteverifyError(w, SiteverifyMissingSecret)
+		return
+	}
+	site := h.cap.SiteBySecret(req.Secret)
+	if site == nil && !h.validSecret(req.Secret) {
+		writeSiteverifyError(w, SiteverifyInvalidSecret)
+		return
+	}
+	if req.Response == "" {
+		writeSiteverifyError(w, SiteverifyMissingResponse)
+		return
+	}
+
+	config := h.tokenConfig(r, site)
+	if req.RemoteIP != "" {
+		config = withRemoteIP(config, req.RemoteIP)
+	}
+
+	result, err := h.cap.ValidateTokenContext(r.Context(), req.Response, config)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to validate token")
+		return
+	}
+	if !result.Success {
+		writeSiteverifyError(w, siteverifyCode(result.Code))
+		return
+	}
+
+	resp := SiteverifyResponse{
+		Success:  true,
+		Hostname: result.Hostname,
+		Action:   result.Action,
+	}
+	if result.IssuedAt > 0 {
+		resp.ChallengeTS = time.UnixMilli(result.IssuedAt).UTC().Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// tokenConfig returns the validation configuration for a request, scoped to site if set
+func (h *handler) tokenConfig(r *http.Request, site *Site) *TokenConfig {
+	var config *TokenConfig
+	if h.opts.TokenConfig != nil {
+		config = h.opts.TokenConfig(r)
+	}
+	if site != nil {
+		siteConfig := TokenConfig{}
+		if config != nil {
+			siteConfig = *config
+		}
+		siteConfig.SiteKey = site.Key
+		config = &siteConfig
+	}
+	return config
+}
+
+// withRemoteIP returns a copy of config presenting the client address remoteIP
+// in its binding. Without other presented attributes only the address is
+// checked, as a backend relaying remoteip doesn't know the client's user agent
+// or session.
+func withRemoteIP(config *TokenConfig, remoteIP string) *TokenConfig {
+	remoteConfig := TokenConfig{}
+	if config != nil {
+		remoteConfig = *config
+	}
+	binding := TokenBinding{addressOnly: true}
+	if remoteConfig.Binding != nil {
+		binding = *remoteConfig.Binding
+	}
+	binding.IPPrefix = remoteIP
+	remoteConfig.Binding = &binding
+	return &remoteConfig
+}
+
+// clientIP returns the address of the client making r
+func (h *handler) clientIP(r *http.Request) string {
+	if h.opts.ClientIP != nil {
+		return h.opts.ClientIP(r)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// validSecret reports whether secret is one of the configured siteverify secrets
+func (h *handler) validSecret(secret string) bool {
+	valid := false
+	for _, s := range h.opts.SiteverifySecrets {
+		if subtle.ConstantTimeCompare([]byte(s), []byte(secret)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// decodeBody decodes a size-limited JSON body into v, writing an error response on failure
+func (h *handler) decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body := http.MaxBytesReader(w, r.Body, h.opts.MaxBodyBytes)
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return false
+		}
+		var solErr *SolutionError
+		if errors.As(err, &solErr) {
+			writeError(w, http.StatusBadRequest, "Invalid "+solErr.Error())
+			return false
+		}
+		writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Success: false, Error: message})
+}
+
+// writeSiteverifyError writes a failed siteverify response. Like reCAPTCHA,
+// failures are reported in the body with a 200 status.
+func writeSiteverifyError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusOK, SiteverifyResponse{Success: false, ErrorCodes: []string{code}})
+}
+
+// siteverifyCode returns the siteverify error code for a validation rejected with reason
+func siteverifyCode(reason string) string {
+	switch reason {
+	case ErrTokenExpired.Code, ErrTokenReused.Code:
+		return SiteverifyTimeoutOrDuplicate
+	default:
+		return SiteverifyInvalidResponse
+	}
+}
+
+// requestHostname returns the hostname of the page a request came from,
+// preferring the Origin header over the Host the request was sent to
+func requestHostname(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err == nil && u.Hostname() != "" {
+			return u.Hostname()
+		}
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
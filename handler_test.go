@@ -0,0 +1,199 @@
+package capserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postJSON sends body to the handler and decodes the JSON response into out
+func postJSON(t *testing.T, h http.Handler, path, body string, out interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: expected JSON content type, got %q", path, ct)
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s: invalid JSON response %q: %v", path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestHandlerFlow(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true})
+	h := NewHandler(cap, &HandlerOptions{
+		Prefix: "/cap/",
+		ChallengeConfig: func(r *http.Request) *ChallengeConfig {
+			return &ChallengeConfig{ChallengeCount: 2, ChallengeDifficulty: 1, Store: true}
+		},
+	})
+
+	var challenge ChallengeResponse
+	if code := postJSON(t, h, "/cap/challenge", "", &challenge); code != http.StatusOK {
+		t.Fatalf("Expected 200 from /challenge, got %d", code)
+	}
+	if len(challenge.Challenge) != 2 || challenge.Token == "" {
+		t.Fatalf("Unexpected challenge response %+v", challenge)
+	}
+
+	body, _ := json.Marshal(Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)})
+	var redeem RedeemResponse
+	if code := postJSON(t, h, "/cap/redeem", string(body), &redeem); code != http.StatusOK {
+		t.Fatalf("Expected 200 from /redeem, got %d", code)
+	}
+	if !redeem.Success || redeem.Token == "" || redeem.Expires == 0 {
+		t.Fatalf("Unexpected redeem response %+v", redeem)
+	}
+
+	body, _ = json.Marshal(map[string]string{"token": redeem.Token})
+	var validation map[string]interface{}
+	if code := postJSON(t, h, "/cap/validate", string(body), &validation); code != http.StatusOK {
+		t.Fatalf("Expected 200 from /validate, got %d", code)
+	}
+	if validation["success"] != true {
+		t.Errorf("Expected successful validation, got %v", validation)
+	}
+	if _, exists := validation["message"]; exists {
+		t.Errorf("Expected no message field, got %v", validation)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	h := NewHandler(New(&CapConfig{NoFSState: true}), &HandlerOptions{MaxBodyBytes: 64})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"unknown path", http.MethodPost, "/nope", "", http.StatusNotFound},
+		{"wrong method", http.MethodGet, "/challenge", "", http.StatusMethodNotAllowed},
+		{"invalid json", http.MethodPost, "/redeem", "{", http.StatusBadRequest},
+		{"missing token", http.MethodPost, "/redeem", `{"solutions":[["a","b",1]]}`, http.StatusBadRequest},
+		{"missing solutions", http.MethodPost, "/redeem", `{"token":"abc"}`, http.StatusBadRequest},
+		{"missing validate token", http.MethodPost, "/validate", `{}`, http.StatusBadRequest},
+		{"body too large", http.MethodPost, "/validate", `{"token":"` + strings.Repeat("a", 100) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, rec.Code)
+			}
+
+			var resp ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Expected JSON error body, got %q", rec.Body.String())
+			}
+			if resp.Success || resp.Error == "" {
+				t.Errorf("Unexpected error body %+v", resp)
+			}
+		})
+	}
+}
+
+// redeemThroughHandler solves a challenge via the handler and returns the verification token
+func redeemThroughHandler(t *testing.T, h http.Handler, origin string) string {
+	t.Helper()
+	var challenge ChallengeResponse
+	postJSON(t, h, "/challenge", "", &challenge)
+
+	body, _ := json.Marshal(Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)})
+	req := httptest.NewRequest(http.MethodPost, "/redeem", strings.NewReader(string(body)))
+	req.Header.Set("Origin", origin)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var redeem RedeemResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &redeem); err != nil || !redeem.Success {
+		t.Fatalf("Expected successful redeem, got %q", rec.Body.String())
+	}
+	return redeem.Token
+}
+
+func TestHandlerSiteverify(t *testing.T) {
+	h := NewHandler(New(&CapConfig{NoFSState: true}), &HandlerOptions{
+		SiteverifySecrets: []string{"backend-secret"},
+		ChallengeConfig: func(r *http.Request) *ChallengeConfig {
+			return &ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true}
+		},
+	})
+
+	token := redeemThroughHandler(t, h, "https://example.com:8443")
+
+	// Form-encoded, like reCAPTCHA clients send it
+	form := url.Values{"secret": {"backend-secret"}, "response": {token}}
+	req := httptest.NewRequest(http.MethodPost, "/siteverify", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var resp SiteverifyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid JSON response %q: %v", rec.Body.String(), err)
+	}
+	if !resp.Success {
+		t.Fatalf("Expected success, got %+v", resp)
+	}
+	if resp.Hostname != "example.com" {
+		t.Errorf("Expected hostname example.com, got %q", resp.Hostname)
+	}
+	if _, err := time.Parse(time.RFC3339, resp.ChallengeTS); err != nil {
+		t.Errorf("Expected RFC 3339 challenge_ts, got %q", resp.ChallengeTS)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		code string
+	}{
+		{"reused token", `{"secret":"backend-secret","response":"` + token + `"}`, SiteverifyTimeoutOrDuplicate},
+		{"missing secret", `{"response":"` + token + `"}`, SiteverifyMissingSecret},
+		{"wrong secret", `{"secret":"nope","response":"` + token + `"}`, SiteverifyInvalidSecret},
+		{"missing response", `{"secret":"backend-secret"}`, SiteverifyMissingResponse},
+		{"invalid json", `{`, SiteverifyBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/siteverify", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			var resp SiteverifyResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Invalid JSON response %q: %v", rec.Body.String(), err)
+			}
+			if rec.Code != http.StatusOK || resp.Success {
+				t.Errorf("Expected failed 200 response, got %d %+v", rec.Code, resp)
+			}
+			if len(resp.ErrorCodes) != 1 || resp.ErrorCodes[0] != tt.code {
+				t.Errorf("Expected error code %s, got %v", tt.code, resp.ErrorCodes)
+			}
+		})
+	}
+
+	// Disabled without secrets
+	plain := NewHandler(New(&CapConfig{NoFSState: true}), nil)
+	req = httptest.NewRequest(http.MethodPost, "/siteverify", strings.NewReader(""))
+	rec = httptest.NewRecorder()
+	plain.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without secrets, got %d", rec.Code)
+	}
+}
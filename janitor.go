@@ -0,0 +1,68 @@
+package capserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrClosed is returned by operations on a Cap that has been closed
+var ErrClosed = errors.New("cap is closed")
+
+// startJanitor sweeps expired state and persists it every interval until the Cap is closed
+func (c *Cap) startJanitor(interval time.Duration) {
+	c.janitorDone = make(chan struct{})
+
+	go func() {
+		defer close(c.janitorDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				if err := c.Cleanup(); err != nil && !errors.Is(err, ErrClosed) {
+					c.logf(context.Background(), "janitor cleanup failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the janitor and flushes state to disk. Further calls return ErrClosed.
+func (c *Cap) Close() error {
+	return c.Shutdown(context.Background())
+}
+
+// Shutdown is like Close but gives up waiting for the janitor when ctx is done.
+// State is still flushed and the store closed, and ctx.Err() is returned.
+func (c *Cap) Shutdown(ctx context.Context) error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+	close(c.stop)
+
+	var err error
+	if c.janitorDone != nil {
+		select {
+		case <-c.janitorDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	if flushErr := c.flush(ctx); flushErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to flush tokens: %w", flushErr))
+	}
+	if closer, ok := c.store.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			return errors.Join(err, closeErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package capserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJanitorSweeps(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true, CleanupIntervalMs: 10})
+	defer cap.Close()
+
+	store := cap.store.(*MemoryStore)
+	store.shards[0].mu.Lock()
+	cap.config.State.ChallengesList["idle"] = &ChallengeData{Expires: time.Now().UnixMilli() - 1, Token: "idle"}
+	store.shards[0].mu.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		store.shards[0].mu.Lock()
+		remaining := len(cap.config.State.ChallengesList)
+		store.shards[0].mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected janitor to sweep the expired challenge")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCloseFlushesAndRejects(t *testing.T) {
+	testFile := "./test_close_tokens.json"
+	defer os.Remove(testFile)
+
+	cap := New(&CapConfig{TokensStorePath: testFile, CleanupIntervalMs: 50})
+	cap.config.State.TokensList["pending"] = time.Now().UnixMilli() + 60000
+
+	if err := cap.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read tokens file: %v", err)
+	}
+	if !strings.Contains(string(data), "pending") {
+		t.Errorf("Expected Close to flush tokens, got %s", data)
+	}
+
+	if _, err := cap.CreateChallenge(nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from CreateChallenge, got %v", err)
+	}
+	if _, err := cap.RedeemChallenge(&Solution{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from RedeemChallenge, got %v", err)
+	}
+	if _, err := cap.ValidateToken("id:token", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from ValidateToken, got %v", err)
+	}
+	if err := cap.Cleanup(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Cleanup, got %v", err)
+	}
+	if err := cap.Shutdown(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from second Shutdown, got %v", err)
+	}
+}
+
+func TestShutdownTimeoutFlushes(t *testing.T) {
+	testFile := "./test_shutdown_tokens.json"
+	defer os.Remove(testFile)
+
+	cap := New(&CapConfig{TokensStorePath: testFile})
+	cap.config.State.TokensList["pending"] = time.Now().UnixMilli() + 60000
+	// A janitor that never finishes
+	cap.janitorDone = make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cap.Shutdown(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the context's error, got %v", err)
+	}
+
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Failed to read tokens file: %v", err)
+	}
+	if !strings.Contains(string(data), "pending") {
+		t.Errorf("Expected Shutdown to flush tokens despite the timeout, got %s", data)
+	}
+	if err := cap.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package capserver
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Signing algorithms supported for verification tokens
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// SigningKey is a key used to sign and verify verification tokens
+type SigningKey struct {
+	ID         string             `json:"id"`               // Key ID carried in the token header
+	Algorithm  string             `json:"alg"`              // AlgHS256 or AlgEdDSA
+	Secret     []byte             `json:"secret,omitempty"` // HMAC secret for AlgHS256
+	PrivateKey ed25519.PrivateKey `json:"-"`                // Signing key for AlgEdDSA
+	PublicKey  ed25519.PublicKey  `json:"-"`                // Verification key for AlgEdDSA (derived from PrivateKey if empty)
+}
+
+// Keyring holds the keys used for signed verification tokens. New tokens are
+// signed with the active key; tokens signed with any key still in the ring verify,
+// so secrets can be rotated without invalidating tokens in flight.
+type Keyring struct {
+	mu     sync.RWMutex
+	active string
+	keys   map[string]*SigningKey
+}
+
+// tokenHeader is the JWS-style header of a signed verification token
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// tokenClaims is the payload of a signed verification token
+type tokenClaims struct {
+	Expires  int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	Nonce    string `json:"nonce"`
+	Site     string `json:"site,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Action   string `json:"act,omitempty"`
+
+	Binding *TokenBinding `json:"bind,omitempty"`
+}
+
+var errMalformedToken = errors.New("malformed token")
+
+// NewKeyring creates a keyring from keys. The first key becomes the active signing key.
+func NewKeyring(keys ...*SigningKey) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]*SigningKey)}
+	for _, key := range keys {
+		if err := k.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Add adds a key to the keyring, making it active if the keyring has no active key
+func (k *Keyring) Add(key *SigningKey) error {
+	if key == nil || key.ID == "" {
+		return errors.New("signing key needs an ID")
+	}
+
+	switch key.Algorithm {
+	case AlgHS256:
+		if len(key.Secret) == 0 {
+			return fmt.Errorf("signing key %s: HS256 needs a secret", key.ID)
+		}
+	case AlgEdDSA:
+		if len(key.PublicKey) == 0 && len(key.PrivateKey) == ed25519.PrivateKeySize {
+			key.PublicKey = key.PrivateKey.Public().(ed25519.PublicKey)
+		}
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("signing key %s: EdDSA needs an ed25519 key", key.ID)
+		}
+	default:
+		return fmt.Errorf("signing key %s: unsupported algorithm %q", key.ID, key.Algorithm)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys[key.ID] = key
+	if k.active == "" {
+		k.active = key.ID
+	}
+	return nil
+}
+
+// SetActive selects the key used to sign new tokens
+func (k *Keyring) SetActive(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, exists := k.keys[id]
+	if !exists {
+		return fmt.Errorf("unknown signing key %s", id)
+	}
+	if !key.canSign() {
+		return fmt.Errorf("signing key %s has no private key", id)
+	}
+	k.active = id
+	return nil
+}
+
+// Remove drops a key; tokens signed with it no longer verify
+func (k *Keyring) Remove(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.keys, id)
+	if k.active == id {
+		k.active = ""
+	}
+}
+
+// sign encodes claims into a compact token signed with the active key
+func (k *Keyring) sign(claims *tokenClaims) (string, error) {
+	k.mu.RLock()
+	key := k.keys[k.active]
+	k.mu.RUnlock()
+
+	if key == nil || !key.canSign() {
+		return "", errors.New("keyring has no active signing key")
+	}
+
+	header, err := json.Marshal(tokenHeader{Alg: key.Algorithm, Kid: key.ID, Typ: "cap"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch key.Algorithm {
+	case AlgHS256:
+		sig = hmacSHA256(key.Secret, signingInput)
+	case AlgEdDSA:
+		sig = ed25519.Sign(key.PrivateKey, []byte(signingInput))
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verify checks a token's signature and returns its claims. Expiry is left to the caller.
+func (k *Keyring) verify(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	var header tokenHeader
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, errMalformedToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	k.mu.RLock()
+	key := k.keys[header.Kid]
+	k.mu.RUnlock()
+
+	// The algorithm comes from our key, never from the token header
+	if key == nil || key.Algorithm != header.Alg {
+		return nil, errBadSignature
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	switch key.Algorithm {
+	case AlgHS256:
+		if !hmac.Equal(sig, hmacSHA256(key.Secret, signingInput)) {
+			return nil, errBadSignature
+		}
+	case AlgEdDSA:
+		if !ed25519.Verify(key.PublicKey, []byte(signingInput), sig) {
+			return nil, errBadSignature
+		}
+	default:
+		return nil, errBadSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Nonce == "" {
+		return nil, errMalformedToken
+	}
+
+	return &claims, nil
+}
+
+// isSignedToken reports whether token looks like a signed verification token
+func isSignedToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (key *SigningKey) canSign() bool {
+	switch key.Algorithm {
+	case AlgHS256:
+		return len(key.Secret) > 0
+	case AlgEdDSA:
+		return len(key.PrivateKey) == ed25519.PrivateKeySize
+	}
+	return false
+}
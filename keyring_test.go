@@ -0,0 +1,165 @@
+package capserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+// redeemSigned solves and redeems a fresh challenge, returning the verification token
+func redeemSigned(t *testing.T, cap *Cap) string {
+	t.Helper()
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	result, err := cap.RedeemChallenge(&Solution{
+		Token:     challenge.Token,
+		Solutions: solveChallenges(t, challenge.Challenge),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("Expected successful redeem, got %+v", result)
+	}
+	return result.Token
+}
+
+func TestSignedTokenHS256(t *testing.T) {
+	keyring, err := NewKeyring(&SigningKey{ID: "k1", Algorithm: AlgHS256, Secret: []byte("secret-1")})
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	issuer := New(&CapConfig{NoFSState: true, TokenKeyring: keyring})
+	verifier := New(&CapConfig{NoFSState: true, TokenKeyring: keyring})
+
+	token := redeemSigned(t, issuer)
+	if !isSignedToken(token) {
+		t.Fatalf("Expected signed token, got %s", token)
+	}
+
+	// Validation needs no state from the issuer
+	result, err := verifier.ValidateToken(token, &TokenConfig{KeepToken: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatal("Expected signed token to validate on another instance")
+	}
+
+	result, _ = verifier.ValidateToken(token, nil)
+	if !result.Success {
+		t.Fatal("Expected kept token to validate again")
+	}
+	result, _ = verifier.ValidateToken(token, nil)
+	if result.Success {
+		t.Error("Expected spent token to be rejected")
+	}
+	result, _ = verifier.ValidateToken(token, &TokenConfig{KeepToken: true})
+	if result.Success {
+		t.Error("Expected spent token to be rejected even when kept")
+	}
+
+	// A changed signature character must fail. Avoid the last character, whose
+	// low bits are padding and may not change the decoded signature.
+	i := len(token) - 5
+	replacement := "A"
+	if token[i] == 'A' {
+		replacement = "B"
+	}
+	tampered := token[:i] + replacement + token[i+1:]
+	result, _ = New(&CapConfig{NoFSState: true, TokenKeyring: keyring}).ValidateToken(tampered, nil)
+	if result.Success {
+		t.Error("Expected tampered token to be rejected")
+	}
+}
+
+func TestSignedTokenRotation(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	keyring, err := NewKeyring(&SigningKey{ID: "old", Algorithm: AlgHS256, Secret: []byte("old-secret")})
+	if err != nil {
+		t.Fatalf("Failed to create keyring: %v", err)
+	}
+	cap := New(&CapConfig{NoFSState: true, TokenKeyring: keyring})
+
+	oldToken := redeemSigned(t, cap)
+
+	if err := keyring.Add(&SigningKey{ID: "new", Algorithm: AlgEdDSA, PrivateKey: priv}); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	if err := keyring.SetActive("new"); err != nil {
+		t.Fatalf("Failed to rotate key: %v", err)
+	}
+	newToken := redeemSigned(t, cap)
+
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		result, err := cap.ValidateToken(token, &TokenConfig{KeepToken: true})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !result.Success {
+			t.Errorf("Expected %s token to validate after rotation", name)
+		}
+	}
+
+	keyring.Remove("old")
+	result, _ := cap.ValidateToken(oldToken, nil)
+	if result.Success {
+		t.Error("Expected token signed with a removed key to be rejected")
+	}
+
+	// A verify-only key can't become the signing key
+	if err := keyring.Add(&SigningKey{ID: "pub", Algorithm: AlgEdDSA, PublicKey: priv.Public().(ed25519.PublicKey)}); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	if err := keyring.SetActive("pub"); err == nil {
+		t.Error("Expected error activating a key without a private key")
+	}
+}
+
+func TestKeyringRejectsInvalidKeys(t *testing.T) {
+	invalid := []*SigningKey{
+		nil,
+		{Algorithm: AlgHS256, Secret: []byte("x")},
+		{ID: "k", Algorithm: AlgHS256},
+		{ID: "k", Algorithm: AlgEdDSA},
+		{ID: "k", Algorithm: "none", Secret: []byte("x")},
+	}
+	for i, key := range invalid {
+		if _, err := NewKeyring(key); err == nil {
+			t.Errorf("Key %d: expected error", i)
+		}
+	}
+}
+
+func TestSignedTokenSharedStore(t *testing.T) {
+	keyring, _ := NewKeyring(&SigningKey{ID: "k1", Algorithm: AlgHS256, Secret: []byte("secret-1")})
+	store := NewMemoryStore(nil, "")
+	issuer := New(&CapConfig{Store: store, TokenKeyring: keyring})
+	defer issuer.Close()
+	replica := New(&CapConfig{Store: store, TokenKeyring: keyring})
+	defer replica.Close()
+
+	token := redeemSigned(t, issuer)
+	if result, _ := replica.ValidateToken(token, &TokenConfig{KeepToken: true}); !result.Success {
+		t.Fatalf("Expected the token to validate on a replica, got %+v", result)
+	}
+	if result, _ := issuer.ValidateToken(token, nil); !result.Success {
+		t.Fatalf("Expected the kept token to validate, got %+v", result)
+	}
+	if result, _ := replica.ValidateToken(token, nil); result.Code != ErrTokenReused.Code {
+		t.Errorf("Expected the token spent on the issuer to be reused on the replica, got %+v", result)
+	}
+
+	// A restarted instance sees the spent nonce in the store
+	restarted := New(&CapConfig{Store: store, TokenKeyring: keyring})
+	defer restarted.Close()
+	if result, _ := restarted.ValidateToken(token, nil); result.Code != ErrTokenReused.Code {
+		t.Errorf("Expected the token to stay spent after a restart, got %+v", result)
+	}
+}
@@ -0,0 +1,616 @@
+package capserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultJournalCompactEvery is the default number of journal entries after which
+// the journal is compacted into the tokens file
+const DefaultJournalCompactEvery = 10000
+
+// journalRecord is one line of the token journal
+type journalRecord struct {
+	Op    string     `json:"op"` // "put" or "del"
+	Key   string     `json:"key"`
+	Token *TokenData `json:"token,omitempty"`
+}
+
+// Close stops write-behind flushing, writes outstanding changes and closes the journal
+func (s *MemoryStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+			<-s.done
+		}
+		s.compactions.Wait()
+
+		err = s.Flush(context.Background())
+		// The journal is folded into the tokens file on the way out
+		if err == nil && s.opts.Journal && s.opts.Path != "" {
+			err = s.compact()
+		}
+
+		s.journalMu.Lock()
+		defer s.journalMu.Unlock()
+		if s.journal != nil {
+			if closeErr := s.journal.Close(); err == nil {
+				err = closeErr
+			}
+			s.journal = nil
+		}
+	})
+	return err
+}
+
+// startWriteBehind flushes pending changes every interval until Close
+func (s *MemoryStore) startWriteBehind(interval time.Duration) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.flushPending()
+			}
+		}
+	}()
+}
+
+// flushPending writes changes held back by write-behind mode
+func (s *MemoryStore) flushPending() {
+	if s.opts.ChallengesPath != "" && s.challengesDirty.Load() {
+		if err := s.saveChallenges(); err != nil {
+			s.logf(context.Background(), "failed to save challenges: %v", err)
+		}
+	}
+
+	if s.opts.Path == "" {
+		return
+	}
+
+	if s.opts.Journal {
+		s.journalMu.Lock()
+		err := s.flushJournalLocked()
+		s.journalMu.Unlock()
+		if err != nil {
+			s.logf(context.Background(), "failed to flush token journal: %v", err)
+		}
+		return
+	}
+
+	if s.dirty.Load() {
+		if err := s.saveTokens(); err != nil {
+			s.logf(context.Background(), "failed to save tokens: %v", err)
+		}
+	}
+}
+
+// recordPut notes a stored token for persistence. Called with the token's shard locked,
+// so journal entries for a key are in the same order as the changes.
+func (s *MemoryStore) recordPut(ctx context.Context, key string, data *TokenData) {
+	if s.opts.Path == "" {
+		return
+	}
+	if !s.opts.Journal {
+		s.dirty.Store(true)
+		return
+	}
+	stored := *data
+	s.appendJournal(ctx, &journalRecord{Op: "put", Key: key, Token: &stored})
+}
+
+// recordDelete notes a removed token for persistence. Called with the token's shard locked.
+func (s *MemoryStore) recordDelete(ctx context.Context, key string) {
+	if s.opts.Path == "" {
+		return
+	}
+	if !s.opts.Journal {
+		s.dirty.Store(true)
+		return
+	}
+	s.appendJournal(ctx, &journalRecord{Op: "del", Key: key})
+}
+
+// afterWrite persists a change once its shard is unlocked
+func (s *MemoryStore) afterWrite(ctx context.Context) {
+	if s.opts.Path == "" {
+		return
+	}
+
+	if s.opts.Journal {
+		s.journalMu.Lock()
+		full := s.journalEntries >= s.opts.CompactEvery
+		s.journalMu.Unlock()
+
+		// Compaction writes every token, so it runs off the request path
+		if full && s.compacting.CompareAndSwap(false, true) {
+			s.compactions.Add(1)
+			go func() {
+				defer s.compactions.Done()
+				defer s.compacting.Store(false)
+				if err := s.compact(); err != nil {
+					s.logf(context.Background(), "failed to compact token journal: %v", err)
+				}
+			}()
+		}
+		return
+	}
+
+	if s.opts.WriteBehindMs <= 0 {
+		if err := s.saveTokens(); err != nil {
+			// Log error but don't fail the operation
+			s.logf(ctx, "failed to save tokens: %v", err)
+		}
+	}
+}
+
+// afterChallengeWrite persists a challenge change once its shard is unlocked
+func (s *MemoryStore) afterChallengeWrite(ctx context.Context) {
+	if s.opts.ChallengesPath == "" || s.opts.WriteBehindMs > 0 {
+		return
+	}
+	if err := s.saveChallenges(); err != nil {
+		s.logf(ctx, "failed to save challenges: %v", err)
+	}
+}
+
+// pendingChallenges reports whether challenge changes haven't been written yet
+func (s *MemoryStore) pendingChallenges() bool {
+	return s.opts.ChallengesPath != "" && s.challengesDirty.Load()
+}
+
+// logf reports a warning through the configured Logger, or prints it
+func (s *MemoryStore) logf(ctx context.Context, format string, args ...interface{}) {
+	if s.opts.Logger != nil {
+		s.opts.Logger(ctx, format, args...)
+		return
+	}
+	fmt.Printf("Warning: "+format+"\n", args...)
+}
+
+// appendJournal adds a record to the journal, writing it through unless in write-behind mode
+func (s *MemoryStore) appendJournal(ctx context.Context, record *journalRecord) {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+
+	if s.journal == nil {
+		f, err := os.OpenFile(s.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			s.logf(ctx, "couldn't open token journal: %v", err)
+			return
+		}
+		s.journal = f
+		s.journalBuf = bufio.NewWriter(f)
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		s.logf(ctx, "failed to encode journal entry: %v", err)
+		return
+	}
+	s.journalBuf.Write(append(line, '\n'))
+	s.journalEntries++
+
+	if s.opts.WriteBehindMs <= 0 {
+		if err := s.flushJournalLocked(); err != nil {
+			s.logf(ctx, "failed to write token journal: %v", err)
+		}
+	}
+}
+
+// flushJournalLocked writes buffered journal entries. journalMu must be held.
+func (s *MemoryStore) flushJournalLocked() error {
+	if s.journal == nil {
+		return nil
+	}
+	if err := s.journalBuf.Flush(); err != nil {
+		return err
+	}
+	if s.opts.Fsync {
+		return s.journal.Sync()
+	}
+	return nil
+}
+
+// compact writes all tokens to the tokens file and removes the journal entries
+// it covers. The shards are only held to snapshot the tokens and rotate the
+// journal; the tokens file is written after releasing them.
+func (s *MemoryStore) compact() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	entries, err := s.rotateJournal()
+	if err != nil {
+		return err
+	}
+	if err := s.writeSnapshot(entries); err != nil {
+		return err
+	}
+
+	// The rotated journal is in the snapshot now
+	if err := os.Remove(s.rotatedJournalPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rotateJournal snapshots the tokens of all shards and moves the journal aside,
+// so entries appended from then on go to a fresh journal. Until the snapshot is
+// written, loading replays the rotated journal before the fresh one.
+func (s *MemoryStore) rotateJournal() (map[string]interface{}, error) {
+	// Hold every shard so no journal entry lands between the snapshot and the rotation
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+	}
+	defer func() {
+		for _, shard := range s.shards {
+			shard.mu.Unlock()
+		}
+	}()
+
+	entries := s.snapshotLocked()
+
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+
+	if s.journal != nil {
+		if err := s.flushJournalLocked(); err != nil {
+			return nil, err
+		}
+		if err := s.journal.Close(); err != nil {
+			return nil, err
+		}
+		s.journal = nil
+		s.journalBuf = nil
+	}
+	s.journalEntries = 0
+
+	// A journal rotated by a compaction that didn't finish is kept, with these entries after it
+	if _, err := os.Stat(s.rotatedJournalPath()); err == nil {
+		return entries, appendJournalFile(s.rotatedJournalPath(), s.journalPath())
+	}
+	if err := os.Rename(s.journalPath(), s.rotatedJournalPath()); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// appendJournalFile moves the entries of the journal at src to the end of dst
+func appendJournalFile(dst, src string) error {
+	data, err := os.ReadFile(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// saveTokens saves tokens from all shards to the storage file
+func (s *MemoryStore) saveTokens() error {
+	// Hold saveMu across snapshot and write so an older snapshot never
+	// overwrites a newer one
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.dirty.Store(false)
+
+	entries := make(map[string]interface{})
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		shard.snapshotInto(entries)
+		shard.mu.Unlock()
+	}
+
+	return s.writeSnapshot(entries)
+}
+
+// snapshotLocked collects tokens from all shards, which must be locked
+func (s *MemoryStore) snapshotLocked() map[string]interface{} {
+	entries := make(map[string]interface{})
+	for _, shard := range s.shards {
+		shard.snapshotInto(entries)
+	}
+	return entries
+}
+
+// snapshotInto adds the shard's tokens to entries as a bare expiry or a TokenData object
+func (sh *memoryShard) snapshotInto(entries map[string]interface{}) {
+	for k, v := range sh.state.TokensList {
+		if tokenData, exists := sh.state.TokensData[k]; exists {
+			stored := *tokenData
+			entries[k] = &stored
+		} else {
+			entries[k] = v
+		}
+	}
+}
+
+// writeSnapshot atomically replaces the tokens file with entries
+func (s *MemoryStore) writeSnapshot(entries map[string]interface{}) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tokens: %w", err)
+	}
+
+	return writeFileAtomic(s.opts.Path, data, s.opts.Fsync)
+}
+
+// loadTokens loads tokens from the storage file and replays the journal into the shards
+func (s *MemoryStore) loadTokens() {
+	path := s.opts.Path
+	dirPath := filepath.Dir(path)
+	if dirPath != "." {
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			s.logf(context.Background(), "couldn't create tokens directory: %v", err)
+			return
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("[cap] Tokens file not found, creating a new empty one\n")
+		if err := writeFileAtomic(path, []byte("{}"), s.opts.Fsync); err != nil {
+			s.logf(context.Background(), "couldn't create tokens file: %v", err)
+		}
+	} else if err != nil {
+		s.logf(context.Background(), "couldn't read tokens file, using empty state: %v", err)
+	}
+
+	// Entries are either a bare expiry or a TokenData object
+	var entries map[string]json.RawMessage
+	if err == nil {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			// Keep the damaged file for inspection instead of overwriting it
+			corruptPath := fmt.Sprintf("%s.corrupt-%d", path, time.Now().UnixMilli())
+			if renameErr := os.Rename(path, corruptPath); renameErr != nil {
+				s.logf(context.Background(), "couldn't parse tokens file, using empty state: %v", err)
+			} else {
+				s.logf(context.Background(), "couldn't parse tokens file, moved it to %s: %v", corruptPath, err)
+			}
+			entries = nil
+		}
+	}
+
+	for _, shard := range s.shards {
+		shard.state.TokensList = make(map[string]int64)
+		shard.state.TokensData = make(map[string]*TokenData)
+	}
+
+	now := time.Now().UnixMilli()
+	for k, raw := range entries {
+		var tokenData TokenData
+		if err := json.Unmarshal(raw, &tokenData.Expires); err != nil {
+			if err := json.Unmarshal(raw, &tokenData); err != nil {
+				s.logf(context.Background(), "skipping unreadable token entry %s: %v", k, err)
+				continue
+			}
+		}
+		s.shard(k).loadToken(k, &tokenData, now)
+	}
+
+	// Fold the journal into a fresh snapshot so it is never replayed twice
+	if s.replayJournal(now) > 0 {
+		if err := s.compact(); err != nil {
+			s.logf(context.Background(), "failed to compact token journal: %v", err)
+		}
+	}
+}
+
+// replayJournal applies the records of a journal rotated by an unfinished
+// compaction and then of the current journal on top of the loaded snapshot,
+// returning how many were applied
+func (s *MemoryStore) replayJournal(now int64) int {
+	return s.replayJournalFile(s.rotatedJournalPath(), now) + s.replayJournalFile(s.journalPath(), now)
+}
+
+// replayJournalFile applies the records of the journal at path and returns how
+// many were applied. A torn final line from a crash is ignored.
+func (s *MemoryStore) replayJournalFile(path string, now int64) int {
+	f, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			s.logf(context.Background(), "couldn't read token journal: %v", err)
+		}
+		return 0
+	}
+	defer f.Close()
+
+	applied := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			s.logf(context.Background(), "stopping token journal replay at unreadable entry: %v", err)
+			break
+		}
+
+		shard := s.shard(record.Key)
+		switch {
+		case record.Op == "put" && record.Token != nil:
+			shard.loadToken(record.Key, record.Token, now)
+		case record.Op == "del":
+			delete(shard.state.TokensList, record.Key)
+			delete(shard.state.TokensData, record.Key)
+		default:
+			continue
+		}
+		applied++
+	}
+	if err := scanner.Err(); err != nil {
+		s.logf(context.Background(), "couldn't read token journal: %v", err)
+	}
+
+	return applied
+}
+
+// loadToken adds a token read from disk to the shard unless it has expired
+func (sh *memoryShard) loadToken(key string, tokenData *TokenData, now int64) {
+	if tokenData.Expires < now {
+		delete(sh.state.TokensList, key)
+		delete(sh.state.TokensData, key)
+		return
+	}
+
+	sh.state.TokensList[key] = tokenData.Expires
+	if tokenData.hasMeta() {
+		stored := *tokenData
+		sh.state.TokensData[key] = &stored
+	} else {
+		delete(sh.state.TokensData, key)
+	}
+}
+
+// saveChallenges writes outstanding challenges from all shards to the challenges file
+func (s *MemoryStore) saveChallenges() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.challengesDirty.Store(false)
+
+	challenges := make(map[string]*ChallengeData)
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		for k, v := range shard.state.ChallengesList {
+			challenges[k] = v
+		}
+		shard.mu.Unlock()
+	}
+
+	data, err := json.Marshal(challenges)
+	if err != nil {
+		return fmt.Errorf("failed to marshal challenges: %w", err)
+	}
+
+	return writeFileAtomic(s.opts.ChallengesPath, data, s.opts.Fsync)
+}
+
+// loadChallenges loads unexpired challenges from the challenges file into the shards
+func (s *MemoryStore) loadChallenges() {
+	path := s.opts.ChallengesPath
+	dirPath := filepath.Dir(path)
+	if dirPath != "." {
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			s.logf(context.Background(), "couldn't create challenges directory: %v", err)
+			return
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			s.logf(context.Background(), "couldn't read challenges file: %v", err)
+		}
+		return
+	}
+
+	var challenges map[string]*ChallengeData
+	if err := json.Unmarshal(data, &challenges); err != nil {
+		corruptPath := fmt.Sprintf("%s.corrupt-%d", path, time.Now().UnixMilli())
+		if renameErr := os.Rename(path, corruptPath); renameErr != nil {
+			s.logf(context.Background(), "couldn't parse challenges file: %v", err)
+		} else {
+			s.logf(context.Background(), "couldn't parse challenges file, moved it to %s: %v", corruptPath, err)
+		}
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	for k, v := range challenges {
+		if v == nil || v.Expires < now {
+			continue
+		}
+		s.shard(k).state.ChallengesList[k] = v
+	}
+}
+
+// challengesPathFor returns the challenges file kept next to a tokens file,
+// e.g. .data/tokensList.challenges.json for .data/tokensList.json
+func challengesPathFor(tokensPath string) string {
+	ext := filepath.Ext(tokensPath)
+	return strings.TrimSuffix(tokensPath, ext) + ".challenges" + ext
+}
+
+func (s *MemoryStore) journalPath() string {
+	return s.opts.Path + ".journal"
+}
+
+func (s *MemoryStore) rotatedJournalPath() string {
+	return s.journalPath() + ".old"
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so a crash leaves either the old or the new file, never a truncated one
+func writeFileAtomic(path string, data []byte, fsync bool) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if fsync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if fsync {
+		// Persist the rename itself
+		if d, err := os.Open(dir); err == nil {
+			d.Sync()
+			d.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package capserver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAtomicSaveAndCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tokens.json")
+	ctx := context.Background()
+
+	store := NewMemoryStore(nil, path)
+	if err := store.PutToken(ctx, "id:hash", &TokenData{Expires: time.Now().UnixMilli() + 60000}); err != nil {
+		t.Fatalf("PutToken failed: %v", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected only the tokens file, found %d files", len(files))
+	}
+
+	// A damaged file is moved aside rather than silently discarded
+	if err := os.WriteFile(path, []byte(`{"id:hash": 12`), 0644); err != nil {
+		t.Fatalf("Failed to corrupt file: %v", err)
+	}
+	NewMemoryStore(nil, path)
+
+	matches, _ := filepath.Glob(path + ".corrupt-*")
+	if len(matches) != 1 {
+		t.Errorf("Expected corrupt file to be preserved, found %v", matches)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ctx := context.Background()
+
+	store := NewMemoryStoreWithOptions(MemoryStoreOptions{Path: path, WriteBehindMs: 60000})
+	if err := store.PutToken(ctx, "pending:hash", &TokenData{Expires: time.Now().UnixMilli() + 60000}); err != nil {
+		t.Fatalf("PutToken failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "pending") {
+		t.Error("Expected write to be deferred")
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	if !strings.Contains(string(data), "pending") {
+		t.Errorf("Expected Close to write pending changes, got %s", data)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ctx := context.Background()
+	expires := time.Now().UnixMilli() + 60000
+
+	store := NewMemoryStoreWithOptions(MemoryStoreOptions{Path: path, Journal: true, CompactEvery: 100})
+	store.PutToken(ctx, "a:hash", &TokenData{Expires: expires, Hostname: "a.example"})
+	store.PutToken(ctx, "b:hash", &TokenData{Expires: expires})
+	store.PutToken(ctx, "c:hash", &TokenData{Expires: expires})
+	store.ConsumeToken(ctx, "b:hash", false)
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "a:hash") {
+		t.Error("Expected changes to go to the journal, not the tokens file")
+	}
+	journal, _ := os.ReadFile(path + ".journal")
+	if lines := strings.Count(string(journal), "\n"); lines != 4 {
+		t.Errorf("Expected 4 journal entries, got %d", lines)
+	}
+
+	// Simulate a crash mid-append
+	f, _ := os.OpenFile(path+".journal", os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"op":"put","key":"torn`)
+	f.Close()
+
+	reloaded := NewMemoryStoreWithOptions(MemoryStoreOptions{Path: path, Journal: true})
+	for key, want := range map[string]bool{"a:hash": true, "b:hash": false, "c:hash": true, "torn": false} {
+		got, _ := reloaded.ConsumeToken(ctx, key, true)
+		if (got != nil) != want {
+			t.Errorf("Token %s: expected present=%v", key, want)
+		}
+	}
+	if got, _ := reloaded.ConsumeToken(ctx, "a:hash", true); got == nil || got.Hostname != "a.example" {
+		t.Errorf("Expected token data to survive replay, got %+v", got)
+	}
+
+	// Replay folds the journal into the tokens file
+	journal, _ = os.ReadFile(path + ".journal")
+	if len(journal) != 0 {
+		t.Errorf("Expected journal to be compacted on load, got %q", journal)
+	}
+	data, _ = os.ReadFile(path)
+	if !strings.Contains(string(data), "a:hash") {
+		t.Errorf("Expected compacted tokens file, got %s", data)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ctx := context.Background()
+	expires := time.Now().UnixMilli() + 60000
+
+	store := NewMemoryStoreWithOptions(MemoryStoreOptions{Path: path, Journal: true, CompactEvery: 3, Shards: 4})
+	for _, key := range []string{"a", "b", "c"} {
+		store.PutToken(ctx, key, &TokenData{Expires: expires})
+	}
+	// The full journal is compacted in the background
+	store.compactions.Wait()
+	store.PutToken(ctx, "d", &TokenData{Expires: expires})
+
+	journal, _ := os.ReadFile(path + ".journal")
+	if lines := strings.Count(string(journal), "\n"); lines != 1 {
+		t.Errorf("Expected 1 journal entry after compaction, got %d", lines)
+	}
+	data, _ := os.ReadFile(path)
+	for _, key := range []string{"a", "b", "c"} {
+		if !strings.Contains(string(data), `"`+key+`"`) {
+			t.Errorf("Expected %s in compacted tokens file, got %s", key, data)
+		}
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	reloaded := NewShardedMemoryStore(4, path)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if got, _ := reloaded.ConsumeToken(ctx, key, true); got == nil {
+			t.Errorf("Expected %s after reload", key)
+		}
+	}
+}
+
+func TestJournalFlushDoesNotCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ctx := context.Background()
+	now := time.Now().UnixMilli()
+
+	cap := New(&CapConfig{TokensStorePath: path, TokensJournal: true})
+	cap.store.PutToken(ctx, "live:hash", &TokenData{Expires: now + 60000})
+	cap.store.PutToken(ctx, "expired:hash", &TokenData{Expires: now - 1})
+	before, _ := os.ReadFile(path)
+
+	// A sweep that removes a token flushes the journal without rewriting the tokens file
+	if err := cap.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(before) {
+		t.Errorf("Expected the tokens file to be left alone, got %s", data)
+	}
+	if journal, _ := os.ReadFile(path + ".journal"); strings.Count(string(journal), "\n") != 2 {
+		t.Errorf("Expected the journal to keep its entries, got %q", journal)
+	}
+
+	// Close folds the journal into the tokens file
+	if err := cap.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if journal, _ := os.ReadFile(path + ".journal"); len(journal) != 0 {
+		t.Errorf("Expected the journal to be compacted on close, got %q", journal)
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "live:hash") || strings.Contains(string(data), "expired:hash") {
+		t.Errorf("Expected only the live token in the tokens file, got %s", data)
+	}
+}
+
+func TestPersistChallenges(t *testing.T) {
+	dir := t.TempDir()
+	config := &CapConfig{
+		TokensStorePath:   filepath.Join(dir, "tokens.json"),
+		PersistChallenges: true,
+	}
+
+	cap := New(config)
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, ChallengeSize: 8, ChallengeDifficulty: 1, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	if _, err := cap.CreateChallenge(&ChallengeConfig{ExpiresMs: 1, Store: true}); err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	if err := cap.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tokens.challenges.json")); err != nil {
+		t.Fatalf("Expected challenges file next to the tokens file: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	restarted := New(config)
+	defer restarted.Close()
+	if len(restarted.config.State.ChallengesList) != 1 {
+		t.Errorf("Expected only the unexpired challenge to be loaded, got %d", len(restarted.config.State.ChallengesList))
+	}
+
+	resp, err := restarted.RedeemChallenge(&Solution{
+		Token:     challenge.Token,
+		Solutions: solveChallenges(t, challenge.Challenge),
+	})
+	if err != nil {
+		t.Fatalf("Failed to redeem challenge: %v", err)
+	}
+	if !resp.Success {
+		t.Errorf("Expected challenge issued before the restart to redeem, got %q", resp.Message)
+	}
+}
+
+func TestPersistChallengesWithoutClose(t *testing.T) {
+	for name, writeBehindMs := range map[string]int{"write-through": 0, "write-behind": 60000} {
+		config := &CapConfig{
+			TokensStorePath:     filepath.Join(t.TempDir(), "tokens.json"),
+			TokensWriteBehindMs: writeBehindMs,
+			PersistChallenges:   true,
+		}
+
+		cap := New(config)
+		defer cap.Close()
+		challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true})
+		if err != nil {
+			t.Fatalf("%s: failed to create challenge: %v", name, err)
+		}
+		// Write-behind stores hold challenges back until the next tick or cleanup
+		if err := cap.Cleanup(); err != nil {
+			t.Fatalf("%s: cleanup failed: %v", name, err)
+		}
+
+		// A second instance stands in for a restart after a crash
+		restarted := New(&CapConfig{TokensStorePath: config.TokensStorePath, PersistChallenges: true})
+		defer restarted.Close()
+		if data, _ := restarted.store.GetChallenge(context.Background(), challenge.Token); data == nil {
+			t.Errorf("%s: expected the challenge to be persisted without Close", name)
+		}
+	}
+}
+
+func TestJournalRotatedReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ctx := context.Background()
+	expires := time.Now().UnixMilli() + 60000
+
+	store := NewMemoryStoreWithOptions(MemoryStoreOptions{Path: path, Journal: true})
+	store.PutToken(ctx, "a:hash", &TokenData{Expires: expires})
+	store.PutToken(ctx, "b:hash", &TokenData{Expires: expires})
+
+	// Simulate a crash after rotating the journal, before the snapshot was written
+	if _, err := store.rotateJournal(); err != nil {
+		t.Fatalf("Failed to rotate journal: %v", err)
+	}
+	store.ConsumeToken(ctx, "a:hash", false)
+	store.PutToken(ctx, "c:hash", &TokenData{Expires: expires})
+
+	reloaded := NewMemoryStoreWithOptions(MemoryStoreOptions{Path: path, Journal: true})
+	defer reloaded.Close()
+	for key, want := range map[string]bool{"a:hash": false, "b:hash": true, "c:hash": true} {
+		got, _ := reloaded.ConsumeToken(ctx, key, true)
+		if (got != nil) != want {
+			t.Errorf("Token %s: expected present=%v", key, want)
+		}
+	}
+	if _, err := os.Stat(path + ".journal.old"); !os.IsNotExist(err) {
+		t.Errorf("Expected the rotated journal to be folded into the tokens file, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package capserver
+
+import (
+	"context"
+	"fmt"
+)
+
+// DifficultyPolicy picks the configuration of a client's challenge, e.g. a
+// trivial puzzle for known-good clients and a heavy one for suspicious networks.
+// info describes the request, with SiteKey filled in, and conf is the
+// configuration CreateChallenge was called with, possibly nil. The policy returns
+// the configuration to use, typically a modified copy of conf, or nil to keep
+// conf. Its SiteKey, Action and Store are ignored: a policy can't move a
+// challenge to another site or action, or make it unredeemable. Name the decision in the returned Decision to have it
+// recorded with the challenge.
+type DifficultyPolicy func(ctx context.Context, info *RequestInfo, conf *ChallengeConfig) (*ChallengeConfig, error)
+
+// applyPolicy returns the configuration the DifficultyPolicy picks for conf
+func (c *Cap) applyPolicy(ctx context.Context, conf *ChallengeConfig) (*ChallengeConfig, error) {
+	if c.config.DifficultyPolicy == nil {
+		return conf, nil
+	}
+
+	ctx = withSite(ctx, conf.siteKey())
+	info := RequestInfoFromContext(ctx)
+	if info == nil {
+		info = &RequestInfo{}
+	}
+
+	picked, err := c.config.DifficultyPolicy(ctx, info, conf)
+	if err != nil {
+		return nil, fmt.Errorf("difficulty policy: %w", err)
+	}
+	if picked == nil {
+		return conf, nil
+	}
+
+	policyConf := *picked
+	policyConf.SiteKey = conf.siteKey()
+	policyConf.Action = ""
+	policyConf.Store = true
+	if conf != nil {
+		policyConf.Action = conf.Action
+		policyConf.Store = conf.Store
+	}
+	return &policyConf, nil
+}
@@ -0,0 +1,138 @@
+package capserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestDifficultyPolicy(t *testing.T) {
+	var seen *RequestInfo
+	policy := func(ctx context.Context, info *RequestInfo, conf *ChallengeConfig) (*ChallengeConfig, error) {
+		seen = info
+		if conf == nil {
+			return nil, nil
+		}
+		picked := *conf
+		switch {
+		case info.ClientIP == "198.51.100.1":
+			return nil, errors.New("reputation service unavailable")
+		case info.Labels["reputation"] == "good":
+			picked.ChallengeDifficulty = 1
+			picked.Decision = "trusted"
+		case info.Labels["reputation"] == "bad":
+			picked.DifficultyBits = 6
+			picked.Decision = "suspicious"
+		default:
+			return nil, nil
+		}
+		picked.SiteKey = "other"
+		return &picked, nil
+	}
+
+	cap := New(&CapConfig{
+		NoFSState:        true,
+		ChallengeSecret:  "secret",
+		Sites:            []*Site{{Key: "s", ChallengeCount: 2}},
+		DifficultyPolicy: policy,
+	})
+	defer cap.Close()
+
+	withLabels := func(reputation string) context.Context {
+		return WithRequestInfo(context.Background(), &RequestInfo{ClientIP: "203.0.113.7", Labels: map[string]string{"reputation": reputation}})
+	}
+
+	for _, store := range []bool{true, false} {
+		ctx := withLabels("good")
+		challenge, err := cap.CreateChallengeContext(ctx, &ChallengeConfig{SiteKey: "s", Store: store})
+		if err != nil {
+			t.Fatalf("Failed to create challenge: %v", err)
+		}
+		if seen.SiteKey != "s" || seen.ClientIP != "203.0.113.7" || RequestInfoFromContext(ctx).SiteKey != "" {
+			t.Errorf("Expected the policy to see the request with its site, got %+v", seen)
+		}
+		if challenge.Decision != "trusted" || len(challenge.Challenge) != 2 || len(challenge.Challenge[0][1]) != 1 {
+			t.Fatalf("Store %v: expected the trusted configuration, got %+v", store, challenge)
+		}
+
+		resp, _ := cap.RedeemChallenge(&Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)})
+		if !resp.Success || resp.Decision != "trusted" {
+			t.Errorf("Store %v: expected the decision to be reported on redeem, got %+v", store, resp)
+		}
+	}
+
+	// The decision is attributed to failed redeems too
+	challenge, _ := cap.CreateChallengeContext(withLabels("bad"), &ChallengeConfig{SiteKey: "s", Store: true})
+	if challenge.Bits != 6 || challenge.Decision != "suspicious" {
+		t.Fatalf("Expected the suspicious configuration, got %+v", challenge)
+	}
+	wrong := failingNonceFor(checkNonceThreshold, challenge.Challenge[0][0], challenge.Challenge[0][1])
+	resp, _ := cap.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: []string{wrong, wrong}})
+	if resp.Success || resp.Decision != "suspicious" {
+		t.Errorf("Expected a failed redeem with the decision, got %+v", resp)
+	}
+
+	// A policy without an opinion keeps the configuration
+	challenge, _ = cap.CreateChallengeContext(withLabels(""), &ChallengeConfig{SiteKey: "s", Store: true})
+	if challenge.Decision != "" || len(challenge.Challenge[0][1]) != DefaultChallengeDifficulty {
+		t.Errorf("Expected the site's configuration, got %+v", challenge)
+	}
+	if data, _ := cap.store.GetChallenge(context.Background(), challenge.Token); data.SiteKey != "s" {
+		t.Errorf("Expected the challenge to stay on its site, got %q", data.SiteKey)
+	}
+
+	ctx := WithRequestInfo(context.Background(), &RequestInfo{ClientIP: "198.51.100.1"})
+	if _, err := cap.CreateChallengeContext(ctx, &ChallengeConfig{Store: true}); err == nil {
+		t.Error("Expected the policy's error to be returned")
+	}
+
+	// A fresh configuration from the policy keeps the caller's storage
+	fresh := New(&CapConfig{
+		NoFSState: true,
+		DifficultyPolicy: func(ctx context.Context, info *RequestInfo, conf *ChallengeConfig) (*ChallengeConfig, error) {
+			return &ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1}, nil
+		},
+	})
+	defer fresh.Close()
+	challenge, _ = fresh.CreateChallenge(&ChallengeConfig{Store: true})
+	if challenge.Token == "" {
+		t.Fatalf("Expected a stored challenge, got %+v", challenge)
+	}
+	if resp, _ := fresh.RedeemChallenge(&Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)}); !resp.Success {
+		t.Errorf("Expected the challenge to redeem, got %+v", resp)
+	}
+	if challenge, _ = fresh.CreateChallenge(nil); challenge.Token == "" {
+		t.Errorf("Expected challenges without a configuration to be stored, got %+v", challenge)
+	}
+
+	// Requests without a RequestInfo get an empty one
+	seen = nil
+	if _, err := cap.CreateChallenge(nil); err != nil || seen == nil {
+		t.Errorf("Expected the policy to be called without a RequestInfo, got %v", err)
+	}
+}
+
+func TestHandlerRequestLabels(t *testing.T) {
+	var labels map[string]string
+	cap := New(&CapConfig{
+		NoFSState: true,
+		DifficultyPolicy: func(ctx context.Context, info *RequestInfo, conf *ChallengeConfig) (*ChallengeConfig, error) {
+			labels = info.Labels
+			return nil, nil
+		},
+	})
+	defer cap.Close()
+
+	h := NewHandler(cap, &HandlerOptions{
+		RequestLabels: func(r *http.Request) map[string]string {
+			return map[string]string{"asn": "AS64496"}
+		},
+	})
+	if status := postJSON(t, h, "/challenge", "{}", nil); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if labels["asn"] != "AS64496" {
+		t.Errorf("Expected the labels in the RequestInfo, got %v", labels)
+	}
+}
@@ -0,0 +1,196 @@
+package capserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Names of the built-in proof-of-work algorithms
+const (
+	PowSHA256 = "sha256"       // SHA-256 of salt+nonce, the default
+	PowROMix  = "romix-sha256" // Memory-hard ROMix over SHA-256
+)
+
+// Bounds of the ROMix parameters
+const (
+	maxROMixMemoryKiB  = 1 << 16 // 64 MiB
+	maxROMixIterations = 64
+)
+
+// PowAlgorithm is the hash whose digest of salt+nonce must meet a challenge's target
+type PowAlgorithm interface {
+	// Params identifies the algorithm and its parameters. They are sent to
+	// clients and recorded with each challenge, which is verified with the
+	// algorithm NewPowAlgorithm returns for them.
+	Params() PowParams
+
+	// Hash returns the digest of data
+	Hash(data []byte) []byte
+}
+
+// PowCost is implemented by algorithms whose hash costs more than one SHA-256.
+// MaxSolutionHashes is counted in SHA-256 evaluations, so each of their hashes
+// takes Cost of it; algorithms without it count as one.
+type PowCost interface {
+	Cost() int
+}
+
+// PowParams names a proof-of-work algorithm and its parameters
+type PowParams struct {
+	Name       string `json:"name"`
+	Memory     int    `json:"memory,omitempty"`     // Memory per hash in KiB, for memory-hard algorithms
+	Iterations int    `json:"iterations,omitempty"` // Passes over that memory
+}
+
+var (
+	powMu         sync.RWMutex
+	powAlgorithms = map[string]func(PowParams) (PowAlgorithm, error){
+		PowSHA256: func(PowParams) (PowAlgorithm, error) { return SHA256(), nil },
+		PowROMix:  func(p PowParams) (PowAlgorithm, error) { return NewROMix(p.Memory, p.Iterations) },
+	}
+)
+
+// RegisterPowAlgorithm makes an algorithm available under name, replacing any
+// registered before. Challenges naming it can only be redeemed once it is registered.
+func RegisterPowAlgorithm(name string, factory func(PowParams) (PowAlgorithm, error)) {
+	powMu.Lock()
+	defer powMu.Unlock()
+
+	powAlgorithms[name] = factory
+}
+
+// NewPowAlgorithm returns the registered algorithm for params
+func NewPowAlgorithm(params PowParams) (PowAlgorithm, error) {
+	powMu.RLock()
+	factory, exists := powAlgorithms[params.Name]
+	powMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown proof-of-work algorithm %q", params.Name)
+	}
+	return factory(params)
+}
+
+// SHA256 returns the default algorithm, hashing salt+nonce once with SHA-256
+func SHA256() PowAlgorithm {
+	return sha256Algorithm{}
+}
+
+type sha256Algorithm struct{}
+
+func (sha256Algorithm) Params() PowParams {
+	return PowParams{Name: PowSHA256}
+}
+
+func (sha256Algorithm) Hash(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// NewROMix returns a memory-hard algorithm: scrypt's ROMix with SHA-256 as its
+// mixing function. Each hash fills memoryKiB of 32-byte blocks with a SHA-256
+// chain seeded by the data, then makes iterations passes of data-dependent
+// reads over them, so solving at speed takes that memory per parallel attempt.
+func NewROMix(memoryKiB, iterations int) (PowAlgorithm, error) {
+	if memoryKiB < 1 || memoryKiB > maxROMixMemoryKiB {
+		return nil, fmt.Errorf("ROMix memory must be between 1 and %d KiB, got %d", maxROMixMemoryKiB, memoryKiB)
+	}
+	if iterations < 1 || iterations > maxROMixIterations {
+		return nil, fmt.Errorf("ROMix iterations must be between 1 and %d, got %d", maxROMixIterations, iterations)
+	}
+	return &romix{memoryKiB: memoryKiB, iterations: iterations}, nil
+}
+
+type romix struct {
+	memoryKiB  int
+	iterations int
+}
+
+func (r *romix) Params() PowParams {
+	return PowParams{Name: PowROMix, Memory: r.memoryKiB, Iterations: r.iterations}
+}
+
+// Hash computes, with n = memoryKiB*1024/32 blocks:
+//
+//	X = SHA256(data)
+//	for i in 0..n-1:               V[i] = X; X = SHA256(X)
+//	for i in 0..iterations*n-1:    j = uint64le(X[0:8]) mod n; X = SHA256(X xor V[j])
+//	return X
+func (r *romix) Hash(data []byte) []byte {
+	n := r.memoryKiB * 1024 / sha256.Size
+	v := make([]byte, n*sha256.Size)
+
+	x := sha256.Sum256(data)
+	for i := 0; i < n; i++ {
+		copy(v[i*sha256.Size:], x[:])
+		x = sha256.Sum256(x[:])
+	}
+
+	for i := 0; i < r.iterations*n; i++ {
+		j := int(binary.LittleEndian.Uint64(x[:8]) % uint64(n))
+		block := v[j*sha256.Size : (j+1)*sha256.Size]
+		for k := range x {
+			x[k] ^= block[k]
+		}
+		x = sha256.Sum256(x[:])
+	}
+	return x[:]
+}
+
+// Cost is the SHA-256 evaluations of one hash: filling the n blocks, the
+// iterations passes over them and the initial hash
+func (r *romix) Cost() int {
+	n := r.memoryKiB * 1024 / sha256.Size
+	return n*(1+r.iterations) + 1
+}
+
+// powCost returns the cost of one hash of alg in SHA-256 evaluations
+func powCost(alg PowAlgorithm) int {
+	if c, ok := alg.(PowCost); ok && c.Cost() > 1 {
+		return c.Cost()
+	}
+	return 1
+}
+
+// powParams returns the params recorded for challenges using alg, nil for the default
+func powParams(alg PowAlgorithm) *PowParams {
+	params := alg.Params()
+	if params.Name == PowSHA256 {
+		return nil
+	}
+	return &params
+}
+
+// check returns how nonces are checked against the challenge's targets and
+// the cost of each check in SHA-256 evaluations
+func (d *ChallengeData) check() (nonceCheck, int, error) {
+	threshold := d.Bits > 0
+	if d.Algorithm == nil || d.Algorithm.Name == PowSHA256 {
+		if threshold {
+			return checkNonceThreshold, 1, nil
+		}
+		return checkNonce, 1, nil
+	}
+
+	alg, err := NewPowAlgorithm(*d.Algorithm)
+	if err != nil {
+		return nil, 0, err
+	}
+	return func(salt, target, nonce string) bool {
+		return matchesTarget(alg.Hash([]byte(salt+nonce)), target, threshold)
+	}, powCost(alg), nil
+}
+
+// acquireMemoryHard waits for one of the MaxMemoryHardVerifications slots,
+// returning the function that frees it
+func (c *Cap) acquireMemoryHard(ctx context.Context) (func(), error) {
+	select {
+	case c.memoryHard <- struct{}{}:
+		return func() { <-c.memoryHard }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,206 @@
+package capserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// solveWith brute-forces a nonce for every challenge using alg
+func solveWith(t testing.TB, alg PowAlgorithm, challenges []ChallengeTuple, threshold bool) []string {
+	t.Helper()
+	nonces := make([]string, len(challenges))
+	for i, ch := range challenges {
+		for n := 0; ; n++ {
+			if matchesTarget(alg.Hash([]byte(ch[0]+strconv.Itoa(n))), ch[1], threshold) {
+				nonces[i] = strconv.Itoa(n)
+				break
+			}
+		}
+	}
+	return nonces
+}
+
+func TestROMix(t *testing.T) {
+	// Outputs of an independent implementation of the documented construction
+	tests := []struct {
+		data       string
+		memoryKiB  int
+		iterations int
+		want       string
+	}{
+		{"salt0", 1, 1, "5d61a00ddec28bcffdfb92124749cae6685cc3579f2b0ba5ce7fd93e8f603186"},
+		{"salt0", 4, 2, "3aa4c03bb97ce52aa3f8bc7a7c7df46d72924f0f2036a350fc02e45b4c8a0ace"},
+		{"", 1, 1, "eecf1f54b229d7875954c1b0b046747a9685bf2792e420f2ccdb29264ba9e0e2"},
+	}
+	for _, tt := range tests {
+		alg, err := NewROMix(tt.memoryKiB, tt.iterations)
+		if err != nil {
+			t.Fatalf("Failed to create ROMix: %v", err)
+		}
+		if got := hex.EncodeToString(alg.Hash([]byte(tt.data))); got != tt.want {
+			t.Errorf("ROMix(%q, %d, %d) = %s, want %s", tt.data, tt.memoryKiB, tt.iterations, got, tt.want)
+		}
+	}
+
+	for _, params := range [][2]int{{0, 1}, {maxROMixMemoryKiB + 1, 1}, {1, 0}, {1, maxROMixIterations + 1}} {
+		if _, err := NewROMix(params[0], params[1]); err == nil {
+			t.Errorf("Expected ROMix(%d, %d) to be refused", params[0], params[1])
+		}
+	}
+}
+
+func TestPowAlgorithm(t *testing.T) {
+	alg, _ := NewROMix(16, 1)
+	cap := New(&CapConfig{NoFSState: true, ChallengeSecret: "secret"})
+	defer cap.Close()
+
+	for _, conf := range []*ChallengeConfig{
+		{ChallengeCount: 2, ChallengeDifficulty: 1, Algorithm: alg, Store: true},
+		{ChallengeCount: 2, DifficultyBits: 3, Algorithm: alg, Store: false},
+		{ChallengeCount: 2, DifficultyBits: 3, Algorithm: alg, Store: true, Seeded: true},
+	} {
+		challenge, err := cap.CreateChallenge(conf)
+		if err != nil {
+			t.Fatalf("Failed to create challenge: %v", err)
+		}
+		if challenge.Algorithm == nil || *challenge.Algorithm != alg.Params() {
+			t.Fatalf("Expected the algorithm params in the response, got %+v", challenge.Algorithm)
+		}
+
+		resp, err := cap.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: solveWith(t, alg, challenge.Challenges(), challenge.Bits > 0)})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !resp.Success {
+			t.Errorf("%+v: expected redeem to succeed, got %+v", conf, resp)
+		}
+	}
+
+	// A nonce solving the SHA-256 puzzle doesn't solve the ROMix one
+	challenge, _ := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 2, Algorithm: alg, Store: true})
+	salt, target := challenge.Challenge[0][0], challenge.Challenge[0][1]
+	var nonce string
+	for n := 0; ; n++ {
+		nonce = strconv.Itoa(n)
+		if checkNonce(salt, target, nonce) && !matchesTarget(alg.Hash([]byte(salt+nonce)), target, false) {
+			break
+		}
+	}
+	resp, _ := cap.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: []string{nonce}})
+	if resp.Success {
+		t.Error("Expected a SHA-256 solution to fail a ROMix challenge")
+	}
+
+	encoded, _ := json.Marshal(challenge)
+	if !strings.Contains(string(encoded), `"algorithm":{"name":"romix-sha256","memory":16,"iterations":1}`) {
+		t.Errorf("Expected the algorithm on the wire, got %s", encoded)
+	}
+
+	// The default stays off the wire
+	plain, _ := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, Algorithm: SHA256(), Store: true})
+	if plain.Algorithm != nil {
+		t.Errorf("Expected no algorithm for SHA-256, got %+v", plain.Algorithm)
+	}
+}
+
+// doubleSHA256 is a custom algorithm for the registry tests
+type doubleSHA256 struct{ name string }
+
+func (d doubleSHA256) Params() PowParams { return PowParams{Name: d.name} }
+
+func (d doubleSHA256) Hash(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+func TestRegisterPowAlgorithm(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true, Sites: []*Site{{Key: "custom", Algorithm: doubleSHA256{"double-sha256"}}}})
+	defer cap.Close()
+
+	if _, err := cap.CreateChallenge(&ChallengeConfig{SiteKey: "custom", Store: true}); err == nil {
+		t.Error("Expected an unregistered algorithm to be refused")
+	}
+
+	RegisterPowAlgorithm("double-sha256", func(PowParams) (PowAlgorithm, error) { return doubleSHA256{"double-sha256"}, nil })
+	defer func() {
+		powMu.Lock()
+		delete(powAlgorithms, "double-sha256")
+		powMu.Unlock()
+	}()
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{SiteKey: "custom", ChallengeCount: 2, ChallengeDifficulty: 1, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	if challenge.Algorithm == nil || challenge.Algorithm.Name != "double-sha256" {
+		t.Fatalf("Expected the site's algorithm, got %+v", challenge.Algorithm)
+	}
+
+	resp, _ := cap.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: solveWith(t, doubleSHA256{}, challenge.Challenge, false)})
+	if !resp.Success {
+		t.Errorf("Expected redeem with the registered algorithm to succeed, got %+v", resp)
+	}
+}
+
+func TestPowWorkBudget(t *testing.T) {
+	alg, _ := NewROMix(16, 1)
+	if cost := powCost(alg); cost != 512*2+1 {
+		t.Fatalf("Expected ROMix(16, 1) to cost 1025 SHA-256 evaluations, got %d", cost)
+	}
+	if cost := powCost(SHA256()); cost != 1 {
+		t.Errorf("Expected SHA-256 to cost 1, got %d", cost)
+	}
+
+	small := New(&CapConfig{NoFSState: true, ChallengeSecret: "secret", MaxSolutionHashes: 3000})
+	defer small.Close()
+	if _, err := small.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, Algorithm: alg, Store: true}); err != nil {
+		t.Errorf("Expected 2 ROMix hashes to fit the budget, got %v", err)
+	}
+	if _, err := small.CreateChallenge(&ChallengeConfig{ChallengeCount: 3, Algorithm: alg, Store: true}); err == nil {
+		t.Error("Expected 3 ROMix hashes to exceed the budget")
+	}
+
+	// A challenge issued under a larger budget is refused before anything is hashed
+	large := New(&CapConfig{NoFSState: true, ChallengeSecret: "secret"})
+	defer large.Close()
+	challenge, err := large.CreateChallenge(&ChallengeConfig{ChallengeCount: 3, ChallengeDifficulty: 1, Algorithm: alg})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	resp, _ := small.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: solveWith(t, alg, challenge.Challenge, false)})
+	if resp.Code != ErrSolutionInvalid.Code {
+		t.Errorf("Expected the work budget to refuse the solution, got %+v", resp)
+	}
+}
+
+func TestMemoryHardVerificationLimit(t *testing.T) {
+	alg, _ := NewROMix(16, 1)
+	cap := New(&CapConfig{NoFSState: true, MaxMemoryHardVerifications: 1})
+	defer cap.Close()
+
+	challenge, _ := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Algorithm: alg, Store: true})
+
+	nonces := solveWith(t, alg, challenge.Challenge, false)
+
+	// With the only slot taken, verification waits until ctx is done
+	cap.memoryHard <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cap.RedeemChallengeContext(ctx, &Solution{Token: challenge.Token, Nonces: nonces}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected to wait for a slot, got %v", err)
+	}
+	<-cap.memoryHard
+
+	// The challenge wasn't taken while waiting, so the solve isn't lost
+	resp, _ := cap.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: nonces})
+	if !resp.Success || len(cap.memoryHard) != 0 {
+		t.Errorf("Expected the freed slot to be used and released, got %+v", resp)
+	}
+}
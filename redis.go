@@ -0,0 +1,393 @@
+package capserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRedisAddr is the default address of the Redis server
+	DefaultRedisAddr = "127.0.0.1:6379"
+	// DefaultRedisPrefix is the default prefix of keys written by RedisStore
+	DefaultRedisPrefix = "cap:"
+	// DefaultRedisPoolSize is the default number of idle connections kept open
+	DefaultRedisPoolSize = 8
+	// DefaultRedisDialTimeoutMs is the default connection timeout in milliseconds
+	DefaultRedisDialTimeoutMs = 5000
+)
+
+// RedisOptions contains configuration options for a RedisStore
+type RedisOptions struct {
+	Addr          string // Server address as host:port (default: DefaultRedisAddr)
+	Password      string // Password sent with AUTH (default: none)
+	DB            int    // Database selected with SELECT (default: 0)
+	Prefix        string // Prefix of every key, so several Caps can share a server (default: DefaultRedisPrefix)
+	PoolSize      int    // Idle connections kept open (default: DefaultRedisPoolSize)
+	DialTimeoutMs int    // Connection timeout in milliseconds (default: DefaultRedisDialTimeoutMs)
+}
+
+// RedisStore is a Store keeping challenges and tokens in a Redis-compatible
+// server. Entries are written with a PX expiry, so the server drops them by
+// itself and Sweep has nothing to do. Tokens are consumed with GETDEL, which
+// needs Redis 6.2 or later, so each token is accepted by one replica only.
+type RedisStore struct {
+	opts   RedisOptions
+	pool   chan *redisConn
+	closed atomic.Bool
+}
+
+// NewRedisStore creates a RedisStore. Connections are opened on first use.
+func NewRedisStore(opts RedisOptions) *RedisStore {
+	if opts.Addr == "" {
+		opts.Addr = DefaultRedisAddr
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultRedisPrefix
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = DefaultRedisPoolSize
+	}
+	if opts.DialTimeoutMs <= 0 {
+		opts.DialTimeoutMs = DefaultRedisDialTimeoutMs
+	}
+
+	return &RedisStore{
+		opts: opts,
+		pool: make(chan *redisConn, opts.PoolSize),
+	}
+}
+
+// PutChallenge stores a challenge under its token until it expires
+func (s *RedisStore) PutChallenge(ctx context.Context, token string, data *ChallengeData) error {
+	return s.set(ctx, s.challengeKey(token), data, data.Expires)
+}
+
+// GetChallenge returns the challenge stored under token, or nil if there is none
+func (s *RedisStore) GetChallenge(ctx context.Context, token string) (*ChallengeData, error) {
+	reply, err := s.do(ctx, "GET", s.challengeKey(token))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	var data ChallengeData
+	if err := decodeRedisValue(reply, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// DeleteChallenge removes a challenge and reports whether it was present
+func (s *RedisStore) DeleteChallenge(ctx context.Context, token string) (bool, error) {
+	reply, err := s.do(ctx, "DEL", s.challengeKey(token))
+	if err != nil {
+		return false, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("redis: unexpected DEL reply %T", reply)
+	}
+	return n > 0, nil
+}
+
+// PutToken stores a verification token under its key until it expires
+func (s *RedisStore) PutToken(ctx context.Context, key string, data *TokenData) error {
+	return s.set(ctx, s.tokenKey(key), data, data.Expires)
+}
+
+// ConsumeToken returns the unexpired token stored under key, removing it
+// atomically with GETDEL unless keep is true
+func (s *RedisStore) ConsumeToken(ctx context.Context, key string, keep bool) (*TokenData, error) {
+	cmd := "GETDEL"
+	if keep {
+		cmd = "GET"
+	}
+
+	reply, err := s.do(ctx, cmd, s.tokenKey(key))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	var data TokenData
+	if err := decodeRedisValue(reply, &data); err != nil {
+		return nil, err
+	}
+	// The server expires keys lazily, so don't trust a just-expired entry
+	if data.Expires < time.Now().UnixMilli() {
+		return nil, ErrTokenExpired
+	}
+	return &data, nil
+}
+
+// Sweep does nothing, as the server expires keys by itself
+func (s *RedisStore) Sweep(ctx context.Context, now int64) (bool, error) {
+	return false, nil
+}
+
+// Close closes idle connections. Further operations return ErrClosed.
+func (s *RedisStore) Close() error {
+	if !s.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	for {
+		select {
+		case conn := <-s.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *RedisStore) challengeKey(token string) string {
+	return s.opts.Prefix + "challenge:" + token
+}
+
+func (s *RedisStore) tokenKey(key string) string {
+	return s.opts.Prefix + "token:" + key
+}
+
+// set writes value as JSON under key with a TTL ending at expires (unix
+// milliseconds). Entries that have already expired are deleted instead.
+func (s *RedisStore) set(ctx context.Context, key string, value interface{}, expires int64) error {
+	ttl := expires - time.Now().UnixMilli()
+	if ttl <= 0 {
+		_, err := s.do(ctx, "DEL", key)
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	_, err = s.do(ctx, "SET", key, string(data), "PX", strconv.FormatInt(ttl, 10))
+	return err
+}
+
+// do sends a command on a pooled connection and returns its reply
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	if s.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	conn, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(ctx, args...)
+	if err != nil {
+		var replyErr redisError
+		if !errors.As(err, &replyErr) {
+			// The connection is in an unknown state after an I/O error
+			conn.Close()
+			return nil, err
+		}
+	}
+	s.put(conn)
+	return reply, err
+}
+
+// get takes an idle connection from the pool or dials a new one
+func (s *RedisStore) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-s.pool:
+		return conn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: time.Duration(s.opts.DialTimeoutMs) * time.Millisecond}
+	netConn, err := dialer.DialContext(ctx, "tcp", s.opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn), w: bufio.NewWriter(netConn)}
+	if s.opts.Password != "" {
+		if _, err := conn.do(ctx, "AUTH", s.opts.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.opts.DB != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(s.opts.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// put returns a connection to the pool, closing it if the pool is full or the store closed
+func (s *RedisStore) put(conn *redisConn) {
+	if s.closed.Load() {
+		conn.Close()
+		return
+	}
+	select {
+	case s.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a single connection speaking RESP
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// do sends a command and reads its reply, giving up when ctx is done
+func (c *redisConn) do(ctx context.Context, args ...string) (reply interface{}, err error) {
+	deadline, hasDeadline := ctx.Deadline()
+	c.SetDeadline(deadline)
+
+	if done := ctx.Done(); done != nil {
+		// Interrupt blocked I/O on cancellation, and wait for the watcher to
+		// finish so it can't touch the connection once it's back in the pool
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-done:
+				c.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-exited
+			if err != nil && ctx.Err() != nil {
+				err = ctx.Err()
+			} else if hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+				// The socket deadline can fire just before ctx notices its own
+				err = context.DeadlineExceeded
+			}
+		}()
+	}
+
+	if err := writeRedisCommand(c.w, args); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	reply, err = readRedisReply(c.r)
+	if err != nil {
+		var replyErr redisError
+		if errors.As(err, &replyErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return reply, nil
+}
+
+// writeRedisCommand writes args as a RESP array of bulk strings
+func writeRedisCommand(w *bufio.Writer, args []string) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(arg))
+		w.WriteString(arg)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRedisReply reads one RESP value. Simple and bulk strings are returned as
+// string, integers as int64, arrays as []interface{} and null replies as nil.
+// Error replies are returned as a redisError.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply type %q", line[0])
+	}
+}
+
+// readRedisLine reads a CRLF-terminated line without its terminator
+func readRedisLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// decodeRedisValue unmarshals a JSON value stored by RedisStore
+func decodeRedisValue(reply interface{}, v interface{}) error {
+	s, ok := reply.(string)
+	if !ok {
+		return fmt.Errorf("redis: unexpected reply %T", reply)
+	}
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		return fmt.Errorf("redis: failed to decode value: %w", err)
+	}
+	return nil
+}
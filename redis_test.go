@@ -0,0 +1,239 @@
+package capserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for the subset of Redis used by RedisStore
+type fakeRedis struct {
+	mu       sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	password string
+}
+
+// startFakeRedis serves the RESP protocol on a local port until the test ends
+func startFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	server := &fakeRedis{
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		password: password,
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authed := f.password == ""
+
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		args, ok := reply.([]interface{})
+		if !ok || len(args) == 0 {
+			fmt.Fprintf(w, "-ERR protocol error\r\n")
+			w.Flush()
+			return
+		}
+		cmd := make([]string, len(args))
+		for i, arg := range args {
+			cmd[i], _ = arg.(string)
+		}
+
+		name := strings.ToUpper(cmd[0])
+		switch {
+		case name == "AUTH":
+			if len(cmd) == 2 && cmd[1] == f.password {
+				authed = true
+				fmt.Fprintf(w, "+OK\r\n")
+			} else {
+				fmt.Fprintf(w, "-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			fmt.Fprintf(w, "-NOAUTH Authentication required.\r\n")
+		default:
+			f.handle(w, name, cmd[1:])
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) handle(w *bufio.Writer, name string, args []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch name {
+	case "PING":
+		fmt.Fprintf(w, "+PONG\r\n")
+	case "SELECT":
+		fmt.Fprintf(w, "+OK\r\n")
+	case "SET":
+		if len(args) != 4 || strings.ToUpper(args[2]) != "PX" {
+			fmt.Fprintf(w, "-ERR syntax error\r\n")
+			return
+		}
+		ms, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || ms <= 0 {
+			fmt.Fprintf(w, "-ERR invalid expire time in 'set' command\r\n")
+			return
+		}
+		f.values[args[0]] = args[1]
+		f.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		fmt.Fprintf(w, "+OK\r\n")
+	case "GET", "GETDEL":
+		value, ok := f.lookup(args[0])
+		if !ok {
+			fmt.Fprintf(w, "$-1\r\n")
+			return
+		}
+		if name == "GETDEL" {
+			delete(f.values, args[0])
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if _, ok := f.lookup(key); ok {
+				delete(f.values, key)
+				n++
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", n)
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", name)
+	}
+}
+
+// lookup returns the value of key, honouring its TTL. f.mu must be held.
+func (f *fakeRedis) lookup(key string) (string, bool) {
+	value, ok := f.values[key]
+	if ok && time.Now().After(f.expires[key]) {
+		delete(f.values, key)
+		return "", false
+	}
+	return value, ok
+}
+
+// keys returns the number of live keys
+func (f *fakeRedis) keys() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for key := range f.values {
+		if _, ok := f.lookup(key); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRedisStore(t *testing.T) {
+	_, addr := startFakeRedis(t, "secret")
+	store := NewRedisStore(RedisOptions{Addr: addr, Password: "secret", DB: 1})
+	defer store.Close()
+
+	testStore(t, store)
+}
+
+func TestRedisStoreTTL(t *testing.T) {
+	server, addr := startFakeRedis(t, "")
+	store := NewRedisStore(RedisOptions{Addr: addr})
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.PutToken(ctx, "short:hash", &TokenData{Expires: time.Now().UnixMilli() + 20}); err != nil {
+		t.Fatalf("PutToken failed: %v", err)
+	}
+	if server.keys() != 1 {
+		t.Fatalf("Expected token to be written, got %d keys", server.keys())
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if server.keys() != 0 {
+		t.Error("Expected the server to expire the token by itself")
+	}
+}
+
+func TestRedisStoreErrors(t *testing.T) {
+	_, addr := startFakeRedis(t, "secret")
+	ctx := context.Background()
+
+	wrong := NewRedisStore(RedisOptions{Addr: addr, Password: "wrong"})
+	if _, err := wrong.GetChallenge(ctx, "token"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected authentication error, got %v", err)
+	}
+
+	store := NewRedisStore(RedisOptions{Addr: addr, Password: "secret"})
+	store.Close()
+	if _, err := store.GetChallenge(ctx, "token"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestRedisStoreWithCap(t *testing.T) {
+	_, addr := startFakeRedis(t, "")
+	store := NewRedisStore(RedisOptions{Addr: addr})
+
+	// Two replicas sharing one server
+	first := New(&CapConfig{Store: store, NoFSState: true})
+	second := New(&CapConfig{Store: NewRedisStore(RedisOptions{Addr: addr}), NoFSState: true})
+	defer first.Close()
+	defer second.Close()
+
+	challenge, err := first.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, ChallengeSize: 8, ChallengeDifficulty: 1, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+
+	resp, err := second.RedeemChallenge(&Solution{
+		Token:     challenge.Token,
+		Solutions: solveChallenges(t, challenge.Challenge),
+	})
+	if err != nil {
+		t.Fatalf("Failed to redeem challenge: %v", err)
+	}
+	if !resp.Success {
+		t.Fatalf("Expected redeem on another replica to succeed, got %q", resp.Message)
+	}
+
+	validation, _ := first.ValidateToken(resp.Token, nil)
+	if !validation.Success {
+		t.Error("Expected token to validate on another replica")
+	}
+	validation, _ = second.ValidateToken(resp.Token, nil)
+	if validation.Success {
+		t.Error("Expected token to be single-use across replicas")
+	}
+}
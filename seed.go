@@ -0,0 +1,116 @@
+package capserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode/utf16"
+)
+
+// ChallengeSeed describes challenges derived from the challenge token instead
+// of being sent one by one. Challenge i, counting from 1, has the salt
+// prng(token+i, Size) and the target prng(token+i+"d", Difficulty), as in
+// upstream Cap's seeded protocol.
+type ChallengeSeed struct {
+	Count      int `json:"c"`           // Number of challenges
+	Size       int `json:"s"`           // Length of each salt in hex characters
+	Difficulty int `json:"d"`           // Length of each target in hex characters
+	Bits       int `json:"b,omitempty"` // Leading zero bits required; every target is then the threshold for them
+}
+
+// Challenges derives the challenges of the seed for token
+func (s ChallengeSeed) Challenges(token string) []ChallengeTuple {
+	challenges := make([]ChallengeTuple, s.Count)
+	for i := range challenges {
+		prefix := token + strconv.Itoa(i+1)
+		target := bitsThreshold(s.Bits)
+		if s.Bits == 0 {
+			target = prng(prefix+"d", s.Difficulty)
+		}
+		challenges[i] = ChallengeTuple{prng(prefix, s.Size), target}
+	}
+	return challenges
+}
+
+// prng returns length hex characters generated by xorshift32 from the 32-bit
+// FNV-1a hash of seed. Like upstream, the hash runs over UTF-16 code units and
+// each output word is padded to 8 characters.
+func prng(seed string, length int) string {
+	state := uint32(2166136261)
+	for _, unit := range utf16.Encode([]rune(seed)) {
+		state ^= uint32(unit)
+		state *= 16777619
+	}
+
+	var b bytes.Buffer
+	for b.Len() < length {
+		state ^= state << 13
+		state ^= state >> 17
+		state ^= state << 5
+		fmt.Fprintf(&b, "%08x", state)
+	}
+	return b.String()[:length]
+}
+
+// challenges returns the challenges to verify, deriving them from the token
+// for seeded challenges
+func (d *ChallengeData) challenges() []ChallengeTuple {
+	if d.Seed != nil {
+		return d.Seed.Challenges(d.Token)
+	}
+	return d.Challenge
+}
+
+// Challenges returns the challenges to solve, deriving them from the token
+// for seeded challenges
+func (r *ChallengeResponse) Challenges() []ChallengeTuple {
+	if r.Seed != nil {
+		return r.Seed.Challenges(r.Token)
+	}
+	return r.Challenge
+}
+
+// challengeResponseJSON is the wire form of ChallengeResponse, whose challenge
+// is either an array of tuples or a seed
+type challengeResponseJSON struct {
+	Challenge interface{} `json:"challenge"`
+	Bits      int         `json:"bits,omitempty"`
+	Algorithm *PowParams  `json:"algorithm,omitempty"`
+	Token     string      `json:"token,omitempty"`
+	Expires   int64       `json:"expires"`
+}
+
+// MarshalJSON encodes the challenge as {"c", "s", "d"} for seeded challenges
+// and as an array of tuples otherwise
+func (r ChallengeResponse) MarshalJSON() ([]byte, error) {
+	var challenge interface{} = r.Challenge
+	if r.Seed != nil {
+		challenge = r.Seed
+	}
+	return json.Marshal(challengeResponseJSON{challenge, r.Bits, r.Algorithm, r.Token, r.Expires})
+}
+
+// UnmarshalJSON decodes either form written by MarshalJSON
+func (r *ChallengeResponse) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Challenge json.RawMessage `json:"challenge"`
+		Bits      int             `json:"bits"`
+		Algorithm *PowParams      `json:"algorithm"`
+		Token     string          `json:"token"`
+		Expires   int64           `json:"expires"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	r.Bits, r.Algorithm, r.Token, r.Expires = raw.Bits, raw.Algorithm, raw.Token, raw.Expires
+	r.Challenge, r.Seed = nil, nil
+	if trimmed := bytes.TrimSpace(raw.Challenge); len(trimmed) > 0 && trimmed[0] == '{' {
+		return json.Unmarshal(trimmed, &r.Seed)
+	}
+	if len(raw.Challenge) > 0 {
+		return json.Unmarshal(raw.Challenge, &r.Challenge)
+	}
+	return nil
+}
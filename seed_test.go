@@ -0,0 +1,118 @@
+package capserver
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPRNG(t *testing.T) {
+	// Outputs of upstream Cap's JavaScript prng
+	tests := []struct {
+		seed   string
+		length int
+		want   string
+	}{
+		{"cap", 32, "90ad4a9a063cdac531e2ba97b0bd502f"},
+		{"token1", 32, "8539570754e5fd8b81c9ec01357bd685"},
+		{"token1d", 4, "4bb7"},
+		{"", 8, "4622a677"},
+		{"héllo✓😀", 20, "71b4ab337e85921a5410"},
+		{"abc123", 5, "15b3f"},
+	}
+	for _, tt := range tests {
+		if got := prng(tt.seed, tt.length); got != tt.want {
+			t.Errorf("prng(%q, %d) = %q, want %q", tt.seed, tt.length, got, tt.want)
+		}
+	}
+
+	challenges := ChallengeSeed{Count: 2, Size: 32, Difficulty: 4}.Challenges("token")
+	if challenges[0] != (ChallengeTuple{"8539570754e5fd8b81c9ec01357bd685", "4bb7"}) {
+		t.Errorf("Unexpected first challenge %v", challenges[0])
+	}
+}
+
+func TestSeededChallenge(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		store bool
+	}{
+		{"stored", true},
+		{"signed", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cap := New(&CapConfig{NoFSState: true, ChallengeSecret: "secret"})
+			defer cap.Close()
+
+			for _, format := range []string{"nonces", "tuples"} {
+				challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 3, ChallengeSize: 16, ChallengeDifficulty: 2, Store: tc.store, Seeded: true})
+				if err != nil {
+					t.Fatalf("Failed to create challenge: %v", err)
+				}
+				if challenge.Challenge != nil || *challenge.Seed != (ChallengeSeed{Count: 3, Size: 16, Difficulty: 2}) {
+					t.Fatalf("Expected only a seed, got %+v", challenge)
+				}
+
+				challenges := challenge.Challenges()
+				if len(challenges) != 3 || len(challenges[0][0]) != 16 || len(challenges[0][1]) != 2 {
+					t.Fatalf("Unexpected derived challenges %v", challenges)
+				}
+
+				solution := &Solution{Token: challenge.Token, Nonces: solveWith(t, SHA256(), challenges, false)}
+				if format == "tuples" {
+					solution = &Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenges)}
+				}
+				resp, err := cap.RedeemChallenge(solution)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if !resp.Success {
+					t.Errorf("%s: expected redeem to succeed, got %+v", format, resp)
+				}
+			}
+
+			// Solutions for another token's challenges are rejected
+			first, _ := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, ChallengeSize: 16, ChallengeDifficulty: 2, Store: tc.store, Seeded: true})
+			second, _ := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, ChallengeSize: 16, ChallengeDifficulty: 2, Store: tc.store, Seeded: true})
+			resp, _ := cap.RedeemChallenge(&Solution{Token: second.Token, Solutions: solveChallenges(t, first.Challenges())})
+			if resp.Success || resp.Code != ErrSolutionMissing.Code {
+				t.Errorf("Expected solutions for another token to be rejected, got %+v", resp)
+			}
+		})
+	}
+}
+
+func TestSeededChallengeStorage(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true, Sites: []*Site{{Key: "seeded", Seeded: true}}})
+	defer cap.Close()
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{SiteKey: "seeded", Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	if challenge.Seed == nil {
+		t.Fatal("Expected the site to default to seeded challenges")
+	}
+
+	stored := cap.config.State.ChallengesList[challenge.Token]
+	if stored.Challenge != nil || stored.Seed == nil || stored.Seed.Count != DefaultChallengeCount {
+		t.Errorf("Expected only the seed to be stored, got %+v", stored)
+	}
+
+	encoded, _ := json.Marshal(challenge)
+	if !strings.Contains(string(encoded), `"challenge":{"c":50,"s":32,"d":4}`) {
+		t.Errorf("Expected the seed on the wire, got %s", encoded)
+	}
+	var decoded ChallengeResponse
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if decoded.Seed == nil || decoded.Challenges()[49] != challenge.Challenges()[49] {
+		t.Errorf("Expected the seed to round-trip, got %+v", decoded)
+	}
+
+	// Without a store or secret there is no token to derive the challenges from
+	if _, err := New(&CapConfig{NoFSState: true}).CreateChallenge(&ChallengeConfig{Seeded: true}); err == nil {
+		t.Error("Expected an error for an unstored seeded challenge without a secret")
+	}
+}
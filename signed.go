@@ -0,0 +1,144 @@
+package capserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// signedChallengePayload is the data carried inside a stateless challenge token
+type signedChallengePayload struct {
+	Challenge []ChallengeTuple `json:"c,omitempty"`
+	Seed      *ChallengeSeed   `json:"d,omitempty"`
+	Bits      int              `json:"b,omitempty"`
+	Algorithm *PowParams       `json:"a,omitempty"`
+	Issued    int64            `json:"i,omitempty"`
+	Expires   int64            `json:"e"`
+	Nonce     string           `json:"n"`
+	SiteKey   string           `json:"s,omitempty"`
+	Decision  string           `json:"p,omitempty"`
+	Action    string           `json:"t,omitempty"`
+}
+
+var errBadSignature = errors.New("invalid signature")
+
+// signChallenge encodes a challenge into a token signed with secret
+func signChallenge(secret []byte, payload *signedChallengePayload) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(data)
+	return body + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256(secret, body)), nil
+}
+
+// parseSignedChallenge verifies a token produced by signChallenge and returns its payload
+func parseSignedChallenge(secret []byte, token string) (*signedChallengePayload, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errBadSignature
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, hmacSHA256(secret, body)) {
+		return nil, errBadSignature
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload signedChallengePayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Nonce == "" {
+		return nil, errors.New("missing nonce")
+	}
+
+	return &payload, nil
+}
+
+// replayKey is the key a stateless challenge's nonce is stored under in a shared
+// store until it is redeemed. The dot keeps it from being taken for a stored challenge.
+func replayKey(nonce string) string {
+	return "replay." + nonce
+}
+
+// tokenNonceKey is the key a signed verification token's nonce is stored under
+// in a shared store until the token is spent
+func tokenNonceKey(nonce string) string {
+	return "nonce." + nonce
+}
+
+// sharedReplay reports whether stateless challenges and signed token nonces are
+// tracked in the store, which is only shared between instances when it was
+// passed in CapConfig.Store
+func (c *Cap) sharedReplay() bool {
+	return c.config.Store != nil
+}
+
+// isSignedChallenge reports whether token looks like a stateless challenge token
+func isSignedChallenge(token string) bool {
+	return strings.Contains(token, ".")
+}
+
+func hmacSHA256(secret []byte, data string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// replayCache remembers used one-time identifiers until they expire. Expiry is
+// indexed in a min-heap so sweeping costs time proportional to what expired.
+type replayCache struct {
+	mu     sync.Mutex
+	seen   map[string]int64
+	expiry expiryHeap
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]int64)}
+}
+
+// use marks id as used until expires and reports whether it was unused
+func (r *replayCache) use(id string, expires int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.seen[id]; exists {
+		return false
+	}
+	r.seen[id] = expires
+	r.expiry.schedule(id, expires, false)
+	return true
+}
+
+// contains reports whether id has been used
+func (r *replayCache) contains(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, exists := r.seen[id]
+	return exists
+}
+
+// sweep forgets identifiers that expired before now
+func (r *replayCache) sweep(now int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		entry, ok := r.expiry.popExpired(now)
+		if !ok {
+			break
+		}
+		delete(r.seen, entry.key)
+	}
+}
@@ -0,0 +1,138 @@
+package capserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStatelessChallenge(t *testing.T) {
+	config := &CapConfig{NoFSState: true, ChallengeSecret: "test-secret"}
+	issuer := New(config)
+	redeemer := New(config)
+
+	challenge, err := issuer.CreateChallenge(&ChallengeConfig{
+		ChallengeCount:      2,
+		ChallengeDifficulty: 1,
+		Store:               false,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	if challenge.Token == "" {
+		t.Fatal("Expected signed token for stateless challenge")
+	}
+
+	solutions := solveChallenges(t, challenge.Challenge)
+
+	// Another instance sharing the secret can redeem without shared state
+	result, err := redeemer.RedeemChallenge(&Solution{Token: challenge.Token, Solutions: solutions})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("Expected successful redeem, got %+v", result)
+	}
+
+	// Replays are rejected
+	result, err = redeemer.RedeemChallenge(&Solution{Token: challenge.Token, Solutions: solutions})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Success {
+		t.Error("Expected replayed challenge to be rejected")
+	}
+}
+
+func TestStatelessChallengeTampered(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true, ChallengeSecret: "test-secret"})
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{
+		ChallengeCount:      1,
+		ChallengeDifficulty: 1,
+		Store:               false,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+
+	// Swap in an easier challenge and keep the original signature
+	body, sig, _ := strings.Cut(challenge.Token, ".")
+	forged, err := signChallenge([]byte("other-secret"), &signedChallengePayload{
+		Challenge: []ChallengeTuple{{"00", "0"}},
+		Expires:   challenge.Expires,
+		Nonce:     "forged",
+	})
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	forgedBody, _, _ := strings.Cut(forged, ".")
+	if forgedBody == body {
+		t.Fatal("Expected forged body to differ")
+	}
+
+	result, err := cap.RedeemChallenge(&Solution{
+		Token:     forgedBody + "." + sig,
+		Solutions: solveChallenges(t, []ChallengeTuple{{"00", "0"}}),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Success {
+		t.Error("Expected tampered token to be rejected")
+	}
+
+	// Without a secret the token can't be verified at all
+	other := New(&CapConfig{NoFSState: true})
+	result, err = other.RedeemChallenge(&Solution{
+		Token:     challenge.Token,
+		Solutions: solveChallenges(t, challenge.Challenge),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Success {
+		t.Error("Expected signed token to be rejected without a secret")
+	}
+}
+
+func TestStatelessChallengeSharedReplay(t *testing.T) {
+	store := NewMemoryStore(nil, "")
+	a := New(&CapConfig{NoFSState: true, ChallengeSecret: "test-secret", Store: store})
+	b := New(&CapConfig{NoFSState: true, ChallengeSecret: "test-secret", Store: store})
+
+	challenge, err := a.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, ChallengeDifficulty: 1, Store: false})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	solution := &Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)}
+
+	if resp, _ := b.RedeemChallenge(solution); !resp.Success {
+		t.Fatalf("Expected redeem on another instance to succeed, got %+v", resp)
+	}
+	if resp, _ := a.RedeemChallenge(solution); resp.Success || resp.Code != ErrChallengeNotFound.Code {
+		t.Errorf("Expected the shared store to stop a replay on the issuer, got %+v", resp)
+	}
+
+	// The nonce marker itself can't be redeemed as a stored challenge, even by
+	// an instance that doesn't know the secret
+	plain := New(&CapConfig{NoFSState: true, Store: store})
+	other, _ := a.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: false})
+	payload, _ := parseSignedChallenge([]byte("test-secret"), other.Token)
+	if resp, _ := plain.RedeemChallenge(&Solution{Token: replayKey(payload.Nonce), Nonces: []string{}}); resp.Success {
+		t.Errorf("Expected the replay marker to be refused, got %+v", resp)
+	}
+}
+
+func TestReplayCacheSweep(t *testing.T) {
+	r := newReplayCache()
+	r.use("old", 10)
+	r.use("new", 30)
+	if r.use("old", 10) {
+		t.Error("Expected a used identifier to be refused")
+	}
+
+	r.sweep(20)
+	if r.contains("old") || !r.contains("new") || len(r.expiry) != 1 {
+		t.Errorf("Expected only the expired identifier to be swept, got %v", r.seen)
+	}
+}
@@ -0,0 +1,130 @@
+package capserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ErrUnknownSite is returned when a challenge is requested for a site key that isn't configured
+var ErrUnknownSite = errors.New("unknown site")
+
+// Site describes a tenant with its own secret, challenge policy and token namespace
+type Site struct {
+	Key                 string   `json:"key"`                           // Public site key
+	Secret              string   `json:"secret,omitempty"`              // Secret used by the site's backend for siteverify
+	ChallengeCount      int      `json:"challengeCount,omitempty"`      // Default number of challenges (default: DefaultChallengeCount)
+	ChallengeSize       int      `json:"challengeSize,omitempty"`       // Default challenge size (default: DefaultChallengeSize)
+	ChallengeDifficulty int      `json:"challengeDifficulty,omitempty"` // Default difficulty (default: DefaultChallengeDifficulty)
+	DifficultyBits      int      `json:"difficultyBits,omitempty"`      // Default difficulty in leading zero bits, used instead of ChallengeDifficulty (default: 0)
+	ExpiresMs           int      `json:"expiresMs,omitempty"`           // Default challenge expiration in milliseconds (default: DefaultExpiresMs)
+	TokenExpiresMs      int      `json:"tokenExpiresMs,omitempty"`      // Verification token lifetime in milliseconds (default: DefaultTokenExpiresMs)
+	Seeded              bool     `json:"seeded,omitempty"`              // Whether challenges are derived from a seed (default: false)
+	AllowedOrigins      []string `json:"allowedOrigins,omitempty"`      // Origins allowed to request challenges (default: any)
+
+	Algorithm PowAlgorithm `json:"-"` // Default proof-of-work algorithm (default: SHA256())
+}
+
+// LoadSites reads a JSON array of site definitions from path
+func LoadSites(path string) ([]*Site, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sites file: %w", err)
+	}
+
+	var sites []*Site
+	if err := json.Unmarshal(data, &sites); err != nil {
+		return nil, fmt.Errorf("failed to parse sites file: %w", err)
+	}
+	return sites, nil
+}
+
+// AddSite adds a site, replacing any existing site with the same key
+func (c *Cap) AddSite(site *Site) error {
+	if site == nil || site.Key == "" {
+		return errors.New("site needs a key")
+	}
+
+	stored := *site
+	stored.AllowedOrigins = append([]string(nil), site.AllowedOrigins...)
+
+	c.sitesMu.Lock()
+	defer c.sitesMu.Unlock()
+
+	c.sites[site.Key] = &stored
+	return nil
+}
+
+// RemoveSite removes a site and reports whether it existed. Tokens already
+// issued for it stop validating against its key only once they expire.
+func (c *Cap) RemoveSite(key string) bool {
+	c.sitesMu.Lock()
+	defer c.sitesMu.Unlock()
+
+	_, exists := c.sites[key]
+	delete(c.sites, key)
+	return exists
+}
+
+// Site returns a copy of the site with the given key, or nil if there is none
+func (c *Cap) Site(key string) *Site {
+	c.sitesMu.RLock()
+	defer c.sitesMu.RUnlock()
+
+	site, exists := c.sites[key]
+	if !exists {
+		return nil
+	}
+	copied := *site
+	return &copied
+}
+
+// Sites returns copies of all configured sites ordered by key
+func (c *Cap) Sites() []*Site {
+	c.sitesMu.RLock()
+	defer c.sitesMu.RUnlock()
+
+	sites := make([]*Site, 0, len(c.sites))
+	for _, site := range c.sites {
+		copied := *site
+		sites = append(sites, &copied)
+	}
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Key < sites[j].Key })
+	return sites
+}
+
+// SiteBySecret returns the site whose secret matches, or nil if there is none
+func (c *Cap) SiteBySecret(secret string) *Site {
+	if secret == "" {
+		return nil
+	}
+
+	c.sitesMu.RLock()
+	defer c.sitesMu.RUnlock()
+
+	var found *Site
+	for _, site := range c.sites {
+		if site.Secret != "" && subtle.ConstantTimeCompare([]byte(site.Secret), []byte(secret)) == 1 {
+			copied := *site
+			found = &copied
+		}
+	}
+	return found
+}
+
+// AllowsOrigin reports whether a request from origin may use the site
+func (s *Site) AllowsOrigin(origin string) bool {
+	if len(s.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package capserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSiteDefaultsAndScoping(t *testing.T) {
+	cap := New(&CapConfig{
+		NoFSState: true,
+		Sites: []*Site{
+			{Key: "site-a", Secret: "secret-a", ChallengeCount: 2, ChallengeDifficulty: 1, TokenExpiresMs: 5000},
+			{Key: "site-b", Secret: "secret-b"},
+		},
+	})
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{SiteKey: "site-a", Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	if len(challenge.Challenge) != 2 || len(challenge.Challenge[0][1]) != 1 {
+		t.Fatalf("Expected site defaults to apply, got %v", challenge.Challenge)
+	}
+
+	result, err := cap.RedeemChallenge(&Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("Expected successful redeem, got %+v", result)
+	}
+	if ttl := result.Expires - time.Now().UnixMilli(); ttl > 5000 {
+		t.Errorf("Expected site token TTL of at most 5000ms, got %d", ttl)
+	}
+
+	// Site B's backend can't burn site A's tokens by validating them
+	validation, err := cap.ValidateToken(result.Token, &TokenConfig{SiteKey: "site-b"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if validation.Success || validation.Code != ErrSiteMismatch.Code {
+		t.Errorf("Expected token for site-a to fail for site-b, got %+v", validation)
+	}
+
+	validation, err = cap.ValidateToken(result.Token, &TokenConfig{SiteKey: "site-a"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !validation.Success {
+		t.Error("Expected token to validate for its own site")
+	}
+
+	if _, err := cap.CreateChallenge(&ChallengeConfig{SiteKey: "missing"}); !errors.Is(err, ErrUnknownSite) {
+		t.Errorf("Expected ErrUnknownSite, got %v", err)
+	}
+}
+
+func TestSiteManagement(t *testing.T) {
+	sitesFile := "./test_sites.json"
+	defer os.Remove(sitesFile)
+
+	data := `[{"key":"one","secret":"s1","challengeDifficulty":3,"allowedOrigins":["https://one.example"]},{"key":"two","secret":"s2"}]`
+	if err := os.WriteFile(sitesFile, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write sites file: %v", err)
+	}
+
+	sites, err := LoadSites(sitesFile)
+	if err != nil {
+		t.Fatalf("Failed to load sites: %v", err)
+	}
+	cap := New(&CapConfig{NoFSState: true, Sites: sites})
+
+	if got := cap.Sites(); len(got) != 2 || got[0].Key != "one" || got[1].Key != "two" {
+		t.Fatalf("Unexpected sites %v", got)
+	}
+	if site := cap.SiteBySecret("s2"); site == nil || site.Key != "two" {
+		t.Errorf("Expected secret s2 to resolve to site two, got %v", site)
+	}
+	if site := cap.SiteBySecret("nope"); site != nil {
+		t.Errorf("Expected no site for unknown secret, got %v", site)
+	}
+
+	site := cap.Site("one")
+	if !site.AllowsOrigin("https://one.example") || site.AllowsOrigin("https://evil.example") {
+		t.Error("Unexpected origin check result")
+	}
+
+	if err := cap.AddSite(&Site{Key: "one", ChallengeDifficulty: 5}); err != nil {
+		t.Fatalf("Failed to replace site: %v", err)
+	}
+	if cap.Site("one").ChallengeDifficulty != 5 {
+		t.Error("Expected site to be replaced")
+	}
+	if err := cap.AddSite(&Site{}); err == nil {
+		t.Error("Expected error for site without key")
+	}
+
+	if !cap.RemoveSite("two") || cap.RemoveSite("two") {
+		t.Error("Expected RemoveSite to report presence once")
+	}
+	if cap.Site("two") != nil {
+		t.Error("Expected site to be removed")
+	}
+}
+
+func TestHandlerSites(t *testing.T) {
+	cap := New(&CapConfig{
+		NoFSState: true,
+		Sites: []*Site{
+			{Key: "a", Secret: "secret-a", ChallengeCount: 1, ChallengeDifficulty: 1, AllowedOrigins: []string{"https://a.example"}},
+			{Key: "b", Secret: "secret-b", ChallengeCount: 1, ChallengeDifficulty: 1},
+		},
+	})
+	h := NewHandler(cap, &HandlerOptions{SiteKeyInPath: true})
+
+	do := func(path, origin, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("/missing/challenge", "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown site, got %d", rec.Code)
+	}
+	if rec := do("/a/challenge", "https://evil.example", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for disallowed origin, got %d", rec.Code)
+	}
+
+	rec := do("/a/challenge", "https://a.example", "")
+	var challenge ChallengeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &challenge); err != nil || challenge.Token == "" {
+		t.Fatalf("Expected challenge, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	body, _ := json.Marshal(Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)})
+	rec = do("/a/redeem", "https://a.example", string(body))
+	var redeem RedeemResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &redeem); err != nil || !redeem.Success {
+		t.Fatalf("Expected successful redeem, got %q", rec.Body.String())
+	}
+
+	// The other site's secret must not accept the token
+	var resp SiteverifyResponse
+	rec = do("/siteverify", "", `{"secret":"secret-b","response":"`+redeem.Token+`"}`)
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Success {
+		t.Error("Expected siteverify with another site's secret to fail")
+	}
+
+	// The token was consumed by the failed attempt above, so redeem a new one
+	rec = do("/a/challenge", "https://a.example", "")
+	json.Unmarshal(rec.Body.Bytes(), &challenge)
+	body, _ = json.Marshal(Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)})
+	rec = do("/a/redeem", "https://a.example", string(body))
+	json.Unmarshal(rec.Body.Bytes(), &redeem)
+
+	rec = do("/siteverify", "", `{"secret":"secret-a","response":"`+redeem.Token+`"}`)
+	resp = SiteverifyResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if !resp.Success {
+		t.Errorf("Expected siteverify with the site's secret to succeed, got %+v", resp)
+	}
+}
@@ -0,0 +1,230 @@
+package capserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// SolutionTuple is one solved challenge: its salt and target, and the nonce
+// that was found. On the wire it is a [salt, target, nonce] array whose nonce
+// may be a string or an integer of any size.
+type SolutionTuple struct {
+	Salt   string
+	Target string
+	Nonce  string // Decimal digits for integer nonces, kept exactly as sent
+}
+
+// SolutionError describes a malformed entry in a submitted solution
+type SolutionError struct {
+	Index  int    // Position of the entry in the solutions array
+	Reason string // What is wrong with it
+}
+
+func (e *SolutionError) Error() string {
+	return fmt.Sprintf("solution %d: %s", e.Index, e.Reason)
+}
+
+// UnmarshalJSON decodes a [salt, target, nonce] array
+func (t *SolutionTuple) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return &SolutionError{Reason: "expected a [salt, target, nonce] array"}
+	}
+	if len(parts) != 3 {
+		return &SolutionError{Reason: fmt.Sprintf("expected 3 elements, got %d", len(parts))}
+	}
+
+	if !decodeString(parts[0], &t.Salt) {
+		return &SolutionError{Reason: "salt must be a string"}
+	}
+	if !decodeString(parts[1], &t.Target) {
+		return &SolutionError{Reason: "target must be a string"}
+	}
+
+	nonce, err := decodeNonce(parts[2])
+	if err != nil {
+		return err
+	}
+	t.Nonce = nonce
+	return nil
+}
+
+// MarshalJSON encodes the tuple as a [salt, target, nonce] array
+func (t SolutionTuple) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]string{t.Salt, t.Target, t.Nonce})
+}
+
+// decodeString decodes a JSON string into s, reporting false for any other value including null
+func decodeString(data []byte, s *string) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '"' && json.Unmarshal(data, s) == nil
+}
+
+// decodeNonce returns the text of a JSON string or integer nonce
+func decodeNonce(data []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return "", &SolutionError{Reason: "nonce must be a string or an integer"}
+	}
+	return nonceString(v)
+}
+
+// nonceString converts a decoded nonce to its text, rejecting anything but
+// strings and integers. Floats are accepted only when they hold an integer
+// exactly, as they do when legacy callers decode JSON into interface{}.
+func nonceString(v interface{}) (string, error) {
+	switch n := v.(type) {
+	case string:
+		return n, nil
+	case json.Number:
+		if isIntegerLiteral(string(n)) {
+			return string(n), nil
+		}
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) <= 1<<53 {
+			return strconv.FormatInt(int64(n), 10), nil
+		}
+		return "", &SolutionError{Reason: "nonce is not an exact integer"}
+	case int:
+		return strconv.Itoa(n), nil
+	case int64:
+		return strconv.FormatInt(n, 10), nil
+	case int32:
+		return strconv.FormatInt(int64(n), 10), nil
+	case uint64:
+		return strconv.FormatUint(n, 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(n), 10), nil
+	case uint:
+		return strconv.FormatUint(uint64(n), 10), nil
+	}
+	return "", &SolutionError{Reason: "nonce must be a string or an integer"}
+}
+
+// isIntegerLiteral reports whether s is an optionally negative run of digits
+func isIntegerLiteral(s string) bool {
+	if len(s) > 0 && s[0] == '-' {
+		s = s[1:]
+	}
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// UnmarshalJSON decodes a solution, checking every entry so malformed ones are
+// reported with their position. Solutions may be [salt, target, nonce] tuples,
+// which also fill Solutions for callers that read it, or a flat array of
+// nonces matched to the challenges by position, which fills Nonces.
+func (s *Solution) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Token     string            `json:"token"`
+		Solutions []json.RawMessage `json:"solutions"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	s.Token = raw.Token
+	s.Tuples, s.Solutions, s.Nonces = nil, nil, nil
+	if raw.Solutions == nil {
+		return nil
+	}
+
+	if len(raw.Solutions) > 0 && !isJSONArray(raw.Solutions[0]) {
+		s.Nonces = make([]string, len(raw.Solutions))
+		for i, entry := range raw.Solutions {
+			if isJSONArray(entry) {
+				return &SolutionError{Index: i, Reason: "expected a nonce, as the first entry was one"}
+			}
+			nonce, err := decodeNonce(entry)
+			if err != nil {
+				err.(*SolutionError).Index = i
+				return err
+			}
+			s.Nonces[i] = nonce
+		}
+		return nil
+	}
+
+	s.Tuples = make([]SolutionTuple, len(raw.Solutions))
+	s.Solutions = make([][]interface{}, len(raw.Solutions))
+	for i, entry := range raw.Solutions {
+		if err := json.Unmarshal(entry, &s.Tuples[i]); err != nil {
+			if solErr, ok := err.(*SolutionError); ok {
+				solErr.Index = i
+			}
+			return err
+		}
+		s.Solutions[i] = []interface{}{s.Tuples[i].Salt, s.Tuples[i].Target, s.Tuples[i].Nonce}
+	}
+	return nil
+}
+
+// MarshalJSON encodes the solution in the format it holds: nonces, typed
+// tuples or legacy tuples, in that order of preference
+func (s Solution) MarshalJSON() ([]byte, error) {
+	var solutions interface{} = s.Solutions
+	if s.Nonces != nil {
+		solutions = s.Nonces
+	} else if s.Tuples != nil {
+		solutions = s.Tuples
+	}
+
+	return json.Marshal(struct {
+		Token     string      `json:"token"`
+		Solutions interface{} `json:"solutions"`
+	}{s.Token, solutions})
+}
+
+// isJSONArray reports whether data holds a JSON array
+func isJSONArray(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '['
+}
+
+// empty reports whether no solutions were submitted in any format
+func (s *Solution) empty() bool {
+	return len(s.Nonces) == 0 && len(s.Tuples) == 0 && len(s.Solutions) == 0
+}
+
+// tuples returns the submitted tuples, converting the legacy Solutions field
+// when Tuples wasn't set
+func (s *Solution) tuples() ([]SolutionTuple, error) {
+	if s.Tuples != nil {
+		return s.Tuples, nil
+	}
+
+	tuples := make([]SolutionTuple, len(s.Solutions))
+	for i, sol := range s.Solutions {
+		if len(sol) != 3 {
+			return nil, &SolutionError{Index: i, Reason: fmt.Sprintf("expected 3 elements, got %d", len(sol))}
+		}
+		salt, ok := sol[0].(string)
+		if !ok {
+			return nil, &SolutionError{Index: i, Reason: "salt must be a string"}
+		}
+		target, ok := sol[1].(string)
+		if !ok {
+			return nil, &SolutionError{Index: i, Reason: "target must be a string"}
+		}
+		nonce, err := nonceString(sol[2])
+		if err != nil {
+			err.(*SolutionError).Index = i
+			return nil, err
+		}
+		tuples[i] = SolutionTuple{Salt: salt, Target: target, Nonce: nonce}
+	}
+	return tuples, nil
+}
@@ -0,0 +1,261 @@
+package capserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSolutionTupleDecoding(t *testing.T) {
+	var solution Solution
+	body := `{"token":"t","solutions":[["s1","t1","42"],["s2","t2",42],["s3","t3",123456789012345678901234567890]]}`
+	if err := json.Unmarshal([]byte(body), &solution); err != nil {
+		t.Fatalf("Failed to decode solution: %v", err)
+	}
+
+	want := []SolutionTuple{
+		{"s1", "t1", "42"},
+		{"s2", "t2", "42"},
+		{"s3", "t3", "123456789012345678901234567890"},
+	}
+	if len(solution.Tuples) != len(want) {
+		t.Fatalf("Expected %d tuples, got %d", len(want), len(solution.Tuples))
+	}
+	for i := range want {
+		if solution.Tuples[i] != want[i] {
+			t.Errorf("Tuple %d: expected %+v, got %+v", i, want[i], solution.Tuples[i])
+		}
+	}
+	if len(solution.Solutions) != 3 || solution.Solutions[2][2] != "123456789012345678901234567890" {
+		t.Errorf("Expected legacy Solutions to be filled, got %v", solution.Solutions)
+	}
+
+	encoded, _ := json.Marshal(solution.Tuples[1])
+	if string(encoded) != `["s2","t2","42"]` {
+		t.Errorf("Expected tuple to encode as an array, got %s", encoded)
+	}
+}
+
+func TestSolutionTupleErrors(t *testing.T) {
+	tests := []struct {
+		entry  string
+		reason string
+	}{
+		{`"s1"`, "expected a [salt, target, nonce] array"},
+		{`["s","t"]`, "expected 3 elements, got 2"},
+		{`[null,"t",1]`, "salt must be a string"},
+		{`["s",5,1]`, "target must be a string"},
+		{`["s","t",true]`, "nonce must be a string or an integer"},
+		{`["s","t",{"n":1}]`, "nonce must be a string or an integer"},
+		{`["s","t",1.5]`, "nonce must be a string or an integer"},
+		{`["s","t",1e3]`, "nonce must be a string or an integer"},
+		{`["s","t",null]`, "nonce must be a string or an integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			var solution Solution
+			err := json.Unmarshal([]byte(`{"token":"t","solutions":[["a","b","c"],`+tt.entry+`]}`), &solution)
+
+			var solErr *SolutionError
+			if !errors.As(err, &solErr) {
+				t.Fatalf("Expected a SolutionError, got %v", err)
+			}
+			if solErr.Index != 1 || solErr.Reason != tt.reason {
+				t.Errorf("Expected entry 1 %q, got %d %q", tt.reason, solErr.Index, solErr.Reason)
+			}
+		})
+	}
+}
+
+func TestLegacySolutionConversion(t *testing.T) {
+	valid := &Solution{Solutions: [][]interface{}{{"s", "t", 7}, {"s", "t", float64(1 << 52)}, {"s", "t", int64(-3)}}}
+	tuples, err := valid.tuples()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tuples[0].Nonce != "7" || tuples[1].Nonce != strconv.FormatInt(1<<52, 10) || tuples[2].Nonce != "-3" {
+		t.Errorf("Unexpected nonces %+v", tuples)
+	}
+
+	for _, nonce := range []interface{}{true, float64(1<<53) * 4, 2.5, map[string]interface{}{}} {
+		invalid := &Solution{Solutions: [][]interface{}{{"s", "t", nonce}}}
+		if _, err := invalid.tuples(); err == nil {
+			t.Errorf("Expected nonce %v (%T) to be rejected", nonce, nonce)
+		}
+	}
+}
+
+func TestRedeemBigIntegerNonce(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true})
+	defer cap.Close()
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	salt, target := challenge.Challenge[0][0], challenge.Challenge[0][1]
+
+	// A nonce above 2^53, which a float64 can't hold exactly
+	var nonce string
+	for n := uint64(1<<60) + 1; ; n++ {
+		nonce = strconv.FormatUint(n, 10)
+		hash := sha256.Sum256([]byte(salt + nonce))
+		if strings.HasPrefix(hex.EncodeToString(hash[:]), target) {
+			break
+		}
+	}
+
+	var solution Solution
+	body := `{"token":"` + challenge.Token + `","solutions":[["` + salt + `","` + target + `",` + nonce + `]]}`
+	if err := json.Unmarshal([]byte(body), &solution); err != nil {
+		t.Fatalf("Failed to decode solution: %v", err)
+	}
+
+	resp, err := cap.RedeemChallenge(&solution)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !resp.Success {
+		t.Errorf("Expected integer nonce above 2^53 to be accepted, got %q", resp.Message)
+	}
+}
+
+func TestRedeemRejectsMalformedLegacySolution(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true})
+	defer cap.Close()
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, ChallengeDifficulty: 1, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+
+	resp, err := cap.RedeemChallenge(&Solution{
+		Token:     challenge.Token,
+		Solutions: [][]interface{}{{challenge.Challenge[0][0], challenge.Challenge[0][1], true}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.Success || resp.Code != ErrSolutionInvalid.Code || !strings.Contains(resp.Message, "solution 0") {
+		t.Errorf("Expected malformed entry to be rejected precisely, got %+v", resp)
+	}
+}
+
+func TestHandlerRejectsMalformedSolution(t *testing.T) {
+	h := NewHandler(New(&CapConfig{NoFSState: true}), nil)
+
+	var resp ErrorResponse
+	code := postJSON(t, h, "/redeem", `{"token":"t","solutions":[["s","t",false]]}`, &resp)
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", code)
+	}
+	if resp.Error != "Invalid solution 0: nonce must be a string or an integer" {
+		t.Errorf("Unexpected error %q", resp.Error)
+	}
+}
+
+// failingNonce returns a nonce that doesn't solve the given challenge
+func failingNonce(salt, target string) string {
+	return failingNonceFor(checkNonce, salt, target)
+}
+
+// failingNonceFor returns a nonce that check rejects for the given challenge
+func failingNonceFor(check nonceCheck, salt, target string) string {
+	for n := 0; ; n++ {
+		if nonce := "wrong-" + strconv.Itoa(n); !check(salt, target, nonce) {
+			return nonce
+		}
+	}
+}
+
+func TestNonceArrayDecoding(t *testing.T) {
+	var solution Solution
+	if err := json.Unmarshal([]byte(`{"token":"t","solutions":[12,"34",123456789012345678901234567890]}`), &solution); err != nil {
+		t.Fatalf("Failed to decode solution: %v", err)
+	}
+	want := []string{"12", "34", "123456789012345678901234567890"}
+	if strings.Join(solution.Nonces, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected nonces %v, got %v", want, solution.Nonces)
+	}
+	if solution.Tuples != nil || solution.Solutions != nil {
+		t.Error("Expected only Nonces to be filled for a nonce array")
+	}
+
+	encoded, _ := json.Marshal(solution)
+	if !strings.Contains(string(encoded), `"solutions":["12","34","123456789012345678901234567890"]`) {
+		t.Errorf("Expected nonces to round-trip, got %s", encoded)
+	}
+
+	for body, reason := range map[string]string{
+		`{"token":"t","solutions":[1,["s","t",2]]}`: "expected a nonce, as the first entry was one",
+		`{"token":"t","solutions":[1,2.5]}`:         "nonce must be a string or an integer",
+	} {
+		err := json.Unmarshal([]byte(body), &solution)
+		var solErr *SolutionError
+		if !errors.As(err, &solErr) || solErr.Index != 1 || solErr.Reason != reason {
+			t.Errorf("%s: expected entry 1 %q, got %v", body, reason, err)
+		}
+	}
+}
+
+func TestRedeemNonceArray(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true})
+	defer cap.Close()
+
+	tests := []struct {
+		name   string
+		mutate func(nonces []string, challenges []ChallengeTuple) []string
+		want   error
+	}{
+		{"valid", func(n []string, _ []ChallengeTuple) []string { return n }, nil},
+		{"too few", func(n []string, _ []ChallengeTuple) []string { return n[:2] }, ErrSolutionMissing},
+		{"too many", func(n []string, _ []ChallengeTuple) []string { return append(n, "0") }, ErrSolutionInvalid},
+		{"wrong nonce", func(n []string, c []ChallengeTuple) []string {
+			n[2] = failingNonce(c[2][0], c[2][1])
+			return n
+		}, ErrSolutionInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 3, ChallengeSize: 8, ChallengeDifficulty: 1, Store: true})
+			if err != nil {
+				t.Fatalf("Failed to create challenge: %v", err)
+			}
+			nonces := tt.mutate(solveWith(t, SHA256(), challenge.Challenge, false), challenge.Challenge)
+
+			resp, err := cap.RedeemChallenge(&Solution{Token: challenge.Token, Nonces: nonces})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.Success != (tt.want == nil) || !errors.Is(resp.Err(), tt.want) {
+				t.Errorf("Expected %v, got %+v", tt.want, resp)
+			}
+		})
+	}
+
+	// Both formats are accepted through the handler
+	h := NewHandler(cap, &HandlerOptions{ChallengeConfig: func(r *http.Request) *ChallengeConfig {
+		return &ChallengeConfig{ChallengeCount: 3, ChallengeSize: 8, ChallengeDifficulty: 1, Store: true}
+	}})
+	for _, format := range []string{"nonces", "tuples"} {
+		var challenge ChallengeResponse
+		postJSON(t, h, "/challenge", "", &challenge)
+
+		solution := Solution{Token: challenge.Token, Solutions: solveChallenges(t, challenge.Challenge)}
+		if format == "nonces" {
+			solution = Solution{Token: challenge.Token, Nonces: solveWith(t, SHA256(), challenge.Challenge, false)}
+		}
+		body, _ := json.Marshal(solution)
+
+		var redeem RedeemResponse
+		postJSON(t, h, "/redeem", string(body), &redeem)
+		if !redeem.Success {
+			t.Errorf("%s: expected redeem to succeed, got %+v", format, redeem)
+		}
+	}
+}
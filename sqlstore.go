@@ -0,0 +1,229 @@
+package capserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSQLTablePrefix is the default prefix of the tables used by SQLStore
+const DefaultSQLTablePrefix = "cap_"
+
+// SQLOptions contains configuration options for a SQLStore
+type SQLOptions struct {
+	TablePrefix string // Prefix of the challenges and tokens tables (default: DefaultSQLTablePrefix)
+	Placeholder string // Bind parameter style, "?" or "$" for $1, $2, ... (default: "?")
+}
+
+// SQLStore is a Store keeping challenges and tokens in a database through
+// database/sql. Each table has an indexed expires column so Sweep deletes
+// expired rows without a full scan, and tokens are consumed in a transaction
+// that only succeeds for the caller whose DELETE removed the row. Writes use
+// INSERT ... ON CONFLICT, supported by PostgreSQL and SQLite 3.24 or later.
+type SQLStore struct {
+	db   *sql.DB
+	opts SQLOptions
+
+	challenges string
+	tokens     string
+}
+
+// NewSQLStore creates a SQLStore on db. Call Migrate to create its tables.
+func NewSQLStore(db *sql.DB, opts SQLOptions) *SQLStore {
+	if opts.TablePrefix == "" {
+		opts.TablePrefix = DefaultSQLTablePrefix
+	}
+	if opts.Placeholder == "" {
+		opts.Placeholder = "?"
+	}
+
+	return &SQLStore{
+		db:         db,
+		opts:       opts,
+		challenges: opts.TablePrefix + "challenges",
+		tokens:     opts.TablePrefix + "tokens",
+	}
+}
+
+// MigrationStatements returns the statements creating the store's tables and
+// indexes, for deployments that apply schema changes with their own tooling
+func (s *SQLStore) MigrationStatements() []string {
+	var statements []string
+	for _, table := range []string{s.challenges, s.tokens} {
+		statements = append(statements,
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(255) PRIMARY KEY, data TEXT NOT NULL, expires BIGINT NOT NULL)", table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_expires ON %s (expires)", table, table),
+		)
+	}
+	return statements
+}
+
+// Migrate creates the store's tables and indexes if they don't exist
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	for _, statement := range s.MigrationStatements() {
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to migrate: %w", err)
+		}
+	}
+	return nil
+}
+
+// PutChallenge stores a challenge under its token
+func (s *SQLStore) PutChallenge(ctx context.Context, token string, data *ChallengeData) error {
+	return s.upsert(ctx, s.challenges, token, data, data.Expires)
+}
+
+// GetChallenge returns the challenge stored under token, or nil if there is none.
+// Expired rows are returned too, left for Cap to report as expired and for Sweep.
+func (s *SQLStore) GetChallenge(ctx context.Context, token string) (*ChallengeData, error) {
+	var data ChallengeData
+	_, found, err := s.get(ctx, s.db, s.challenges, token, &data)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// DeleteChallenge removes a challenge and reports whether it was present
+func (s *SQLStore) DeleteChallenge(ctx context.Context, token string) (bool, error) {
+	return s.delete(ctx, s.db, s.challenges, token)
+}
+
+// PutToken stores a verification token under its key
+func (s *SQLStore) PutToken(ctx context.Context, key string, data *TokenData) error {
+	return s.upsert(ctx, s.tokens, key, data, data.Expires)
+}
+
+// ConsumeToken returns the unexpired token stored under key, removing it unless
+// keep is true. Expired rows are left for Sweep.
+func (s *SQLStore) ConsumeToken(ctx context.Context, key string, keep bool) (*TokenData, error) {
+	var data TokenData
+	if keep {
+		expires, found, err := s.get(ctx, s.db, s.tokens, key, &data)
+		if err != nil || !found {
+			return nil, err
+		}
+		if expires < time.Now().UnixMilli() {
+			return nil, ErrTokenExpired
+		}
+		return &data, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	expires, found, err := s.get(ctx, tx, s.tokens, key, &data)
+	if err != nil || !found {
+		return nil, err
+	}
+	if expires < time.Now().UnixMilli() {
+		return nil, ErrTokenExpired
+	}
+
+	// Only the caller whose DELETE removed the row may use the token
+	deleted, err := s.delete(ctx, tx, s.tokens, key)
+	if err != nil || !deleted {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return &data, nil
+}
+
+// Sweep deletes expired challenges and tokens
+func (s *SQLStore) Sweep(ctx context.Context, now int64) (bool, error) {
+	if _, err := s.db.ExecContext(ctx, s.bind("DELETE FROM "+s.challenges+" WHERE expires < ?"), now); err != nil {
+		return false, fmt.Errorf("failed to sweep challenges: %w", err)
+	}
+
+	result, err := s.db.ExecContext(ctx, s.bind("DELETE FROM "+s.tokens+" WHERE expires < ?"), now)
+	if err != nil {
+		return false, fmt.Errorf("failed to sweep tokens: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// sqlQuerier is implemented by *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// upsert writes value as JSON into table under id
+func (s *SQLStore) upsert(ctx context.Context, table, id string, value interface{}, expires int64) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %w", err)
+	}
+
+	query := s.bind("INSERT INTO " + table + " (id, data, expires) VALUES (?, ?, ?) " +
+		"ON CONFLICT (id) DO UPDATE SET data = excluded.data, expires = excluded.expires")
+	if _, err := s.db.ExecContext(ctx, query, id, string(data), expires); err != nil {
+		return fmt.Errorf("failed to write %s: %w", table, err)
+	}
+	return nil
+}
+
+// get decodes the row of table under id into value, returning its expiry and
+// whether there was one
+func (s *SQLStore) get(ctx context.Context, q sqlQuerier, table, id string, value interface{}) (int64, bool, error) {
+	var data string
+	var expires int64
+	err := q.QueryRowContext(ctx, s.bind("SELECT data, expires FROM "+table+" WHERE id = ?"), id).Scan(&data, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read %s: %w", table, err)
+	}
+
+	if err := json.Unmarshal([]byte(data), value); err != nil {
+		return 0, false, fmt.Errorf("failed to decode %s row: %w", table, err)
+	}
+	return expires, true, nil
+}
+
+// delete removes the row of table under id and reports whether it was present
+func (s *SQLStore) delete(ctx context.Context, q sqlQuerier, table, id string) (bool, error) {
+	result, err := q.ExecContext(ctx, s.bind("DELETE FROM "+table+" WHERE id = ?"), id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete from %s: %w", table, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// bind rewrites ? placeholders into the configured parameter style
+func (s *SQLStore) bind(query string) string {
+	if s.opts.Placeholder != "$" {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,334 @@
+package capserver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSQLDriver is a database/sql driver understanding just the statements
+// SQLStore issues, so the store can be tested without a database server
+type fakeSQLDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeSQLDB
+}
+
+type fakeSQLDB struct {
+	mu     sync.Mutex
+	tables map[string]map[string]fakeSQLRow
+}
+
+type fakeSQLRow struct {
+	data    string
+	expires int64
+}
+
+var fakeSQL = &fakeSQLDriver{dbs: make(map[string]*fakeSQLDB)}
+
+func init() {
+	sql.Register("capfake", fakeSQL)
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	db, exists := d.dbs[name]
+	if !exists {
+		db = &fakeSQLDB{tables: make(map[string]map[string]fakeSQLRow)}
+		d.dbs[name] = db
+	}
+	return &fakeSQLConn{db: db}, nil
+}
+
+// openFakeSQL opens an empty fake database named after the test, dropped when it ends
+func openFakeSQL(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("capfake", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeSQL.mu.Lock()
+		delete(fakeSQL.dbs, t.Name())
+		fakeSQL.mu.Unlock()
+	})
+	return db
+}
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error              { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { return fakeSQLTx{}, nil }
+
+// fakeSQLTx doesn't isolate anything; each statement runs atomically, which
+// is all SQLStore relies on
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error   { return nil }
+func (fakeSQLTx) Rollback() error { return nil }
+
+var (
+	fakeSQLCreateTable = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) `)
+	fakeSQLCreateIndex = regexp.MustCompile(`^CREATE INDEX IF NOT EXISTS \w+ ON (\w+) \(expires\)$`)
+	fakeSQLUpsert      = regexp.MustCompile(`^INSERT INTO (\w+) \(id, data, expires\) VALUES \((\?|\$1), (\?|\$2), (\?|\$3)\) ON CONFLICT \(id\) DO UPDATE SET data = excluded.data, expires = excluded.expires$`)
+	fakeSQLSelect      = regexp.MustCompile(`^SELECT data, expires FROM (\w+) WHERE id = (\?|\$1)$`)
+	fakeSQLDelete      = regexp.MustCompile(`^DELETE FROM (\w+) WHERE id = (\?|\$1)$`)
+	fakeSQLSweep       = regexp.MustCompile(`^DELETE FROM (\w+) WHERE expires < (\?|\$1)$`)
+)
+
+type fakeSQLStmt struct {
+	db    *fakeSQLDB
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if m := fakeSQLCreateTable.FindStringSubmatch(s.query); m != nil {
+		if s.db.tables[m[1]] == nil {
+			s.db.tables[m[1]] = make(map[string]fakeSQLRow)
+		}
+		return driver.RowsAffected(0), nil
+	}
+	if m := fakeSQLCreateIndex.FindStringSubmatch(s.query); m != nil {
+		_, err := s.db.table(m[1])
+		return driver.RowsAffected(0), err
+	}
+	if m := fakeSQLUpsert.FindStringSubmatch(s.query); m != nil {
+		table, err := s.db.table(m[1])
+		if err != nil {
+			return nil, err
+		}
+		table[args[0].(string)] = fakeSQLRow{data: args[1].(string), expires: args[2].(int64)}
+		return driver.RowsAffected(1), nil
+	}
+	if m := fakeSQLDelete.FindStringSubmatch(s.query); m != nil {
+		table, err := s.db.table(m[1])
+		if err != nil {
+			return nil, err
+		}
+		id := args[0].(string)
+		if _, exists := table[id]; !exists {
+			return driver.RowsAffected(0), nil
+		}
+		delete(table, id)
+		return driver.RowsAffected(1), nil
+	}
+	if m := fakeSQLSweep.FindStringSubmatch(s.query); m != nil {
+		table, err := s.db.table(m[1])
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for id, row := range table {
+			if row.expires < args[0].(int64) {
+				delete(table, id)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	}
+	return nil, fmt.Errorf("fake driver: unsupported statement %q", s.query)
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	m := fakeSQLSelect.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("fake driver: unsupported query %q", s.query)
+	}
+	table, err := s.db.table(m[1])
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &fakeSQLRows{}
+	if row, exists := table[args[0].(string)]; exists {
+		rows.rows = append(rows.rows, row)
+	}
+	return rows, nil
+}
+
+// table returns the named table. db.mu must be held.
+func (db *fakeSQLDB) table(name string) (map[string]fakeSQLRow, error) {
+	table, exists := db.tables[name]
+	if !exists {
+		return nil, fmt.Errorf("fake driver: no such table %s", name)
+	}
+	return table, nil
+}
+
+type fakeSQLRows struct {
+	rows []fakeSQLRow
+}
+
+func (r *fakeSQLRows) Columns() []string { return []string{"data", "expires"} }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1] = r.rows[0].data, r.rows[0].expires
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// testSQLStore runs the store conformance tests and SQL-specific checks against db
+func testSQLStore(t *testing.T, db *sql.DB, opts SQLOptions) {
+	ctx := context.Background()
+	store := NewSQLStore(db, opts)
+
+	if _, err := store.GetChallenge(ctx, "token"); err == nil {
+		t.Error("Expected an error before Migrate")
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.Migrate(ctx); err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+	}
+
+	testStore(t, store)
+
+	// Concurrent consumers of one token: exactly one may use it
+	if err := store.PutToken(ctx, "race:hash", &TokenData{Expires: time.Now().UnixMilli() + 60000}); err != nil {
+		t.Fatalf("PutToken failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	var accepted atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := store.ConsumeToken(ctx, "race:hash", false)
+			if err != nil {
+				t.Errorf("ConsumeToken failed: %v", err)
+			}
+			if data != nil {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted.Load() != 1 {
+		t.Errorf("Expected exactly one consumer to get the token, got %d", accepted.Load())
+	}
+
+	changed, err := store.Sweep(ctx, time.Now().UnixMilli()+120000)
+	if err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	if !changed {
+		t.Error("Expected sweep to report removed tokens")
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	for _, placeholder := range []string{"?", "$"} {
+		t.Run(placeholder, func(t *testing.T) {
+			testSQLStore(t, openFakeSQL(t), SQLOptions{Placeholder: placeholder})
+		})
+	}
+}
+
+// TestSQLStoreDriver runs the suite against a real database when
+// CAP_TEST_SQL_DRIVER and CAP_TEST_SQL_DSN name a driver linked into the test binary
+func TestSQLStoreDriver(t *testing.T) {
+	name, dsn := os.Getenv("CAP_TEST_SQL_DRIVER"), os.Getenv("CAP_TEST_SQL_DSN")
+	if name == "" {
+		t.Skip("CAP_TEST_SQL_DRIVER not set")
+	}
+
+	db, err := sql.Open(name, dsn)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	prefix := fmt.Sprintf("cap_test_%d_", time.Now().UnixNano())
+	placeholder := os.Getenv("CAP_TEST_SQL_PLACEHOLDER")
+	defer func() {
+		for _, table := range []string{"challenges", "tokens"} {
+			db.Exec("DROP TABLE " + prefix + table)
+		}
+	}()
+
+	testSQLStore(t, db, SQLOptions{TablePrefix: prefix, Placeholder: placeholder})
+}
+
+func TestSQLStoreWithCap(t *testing.T) {
+	store := NewSQLStore(openFakeSQL(t), SQLOptions{})
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	cap := New(&CapConfig{Store: store, NoFSState: true})
+	defer cap.Close()
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 2, ChallengeSize: 8, ChallengeDifficulty: 1, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	resp, err := cap.RedeemChallenge(&Solution{
+		Token:     challenge.Token,
+		Solutions: solveChallenges(t, challenge.Challenge),
+	})
+	if err != nil {
+		t.Fatalf("Failed to redeem challenge: %v", err)
+	}
+	if !resp.Success {
+		t.Fatalf("Expected redeem to succeed, got %q", resp.Message)
+	}
+
+	validation, _ := cap.ValidateToken(resp.Token, nil)
+	if !validation.Success {
+		t.Error("Expected token to validate")
+	}
+	validation, _ = cap.ValidateToken(resp.Token, nil)
+	if validation.Success {
+		t.Error("Expected token to be single-use")
+	}
+
+	// Expired challenges are reported as such, like with MemoryStore
+	expired := &ChallengeData{Challenge: []ChallengeTuple{{"salt", "0"}}, Expires: time.Now().UnixMilli() - 1, Token: "expired"}
+	if err := store.PutChallenge(context.Background(), "expired", expired); err != nil {
+		t.Fatalf("PutChallenge failed: %v", err)
+	}
+	resp, _ = cap.RedeemChallenge(&Solution{Token: "expired", Nonces: []string{"0"}})
+	if resp.Code != ErrChallengeExpired.Code {
+		t.Errorf("Expected challenge_expired, got %+v", resp)
+	}
+}
+
+func TestSQLStoreBind(t *testing.T) {
+	store := NewSQLStore(nil, SQLOptions{Placeholder: "$"})
+	got := store.bind("SELECT a FROM t WHERE b = ? AND c = ?")
+	if want := "SELECT a FROM t WHERE b = $1 AND c = $2"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if strings.Contains(NewSQLStore(nil, SQLOptions{}).bind("x = ?"), "$") {
+		t.Error("Expected ? placeholders to be left alone by default")
+	}
+}
@@ -0,0 +1,361 @@
+package capserver
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"hash/fnv"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenData contains the information stored for a redeemed verification token
+type TokenData struct {
+	Expires  int64  `json:"expires"`
+	IssuedAt int64  `json:"issuedAt,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	SiteKey  string `json:"siteKey,omitempty"`
+	Action   string `json:"action,omitempty"`
+
+	Binding *TokenBinding `json:"binding,omitempty"` // Client the token is bound to, if any
+}
+
+// hasMeta reports whether the token carries more than its expiry
+func (d *TokenData) hasMeta() bool {
+	return *d != TokenData{Expires: d.Expires}
+}
+
+// Store is the storage backend used by Cap for challenges and verification tokens.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// PutChallenge stores a challenge under its token
+	PutChallenge(ctx context.Context, token string, data *ChallengeData) error
+	// GetChallenge returns the challenge stored under token, or nil if there is none
+	GetChallenge(ctx context.Context, token string) (*ChallengeData, error)
+	// DeleteChallenge removes a challenge and reports whether it was present
+	DeleteChallenge(ctx context.Context, token string) (bool, error)
+	// PutToken stores a verification token under its key
+	PutToken(ctx context.Context, key string, data *TokenData) error
+	// ConsumeToken returns the unexpired token stored under key, or nil if there is none.
+	// The token is removed unless keep is true. Stores that still hold an expired
+	// token should return ErrTokenExpired so the rejection can be reported as such.
+	ConsumeToken(ctx context.Context, key string, keep bool) (*TokenData, error)
+	// Sweep removes challenges and tokens that expired before now (unix milliseconds)
+	// and reports whether any tokens were removed
+	Sweep(ctx context.Context, now int64) (bool, error)
+}
+
+// Flusher is implemented by stores that can sync their state to durable storage
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// MemoryStore is the default Store, keeping state in memory and optionally
+// persisting tokens to a JSON file. State is split into shards by key hash,
+// each with its own lock, and expiry is tracked per shard in a min-heap so
+// sweeping costs time proportional to what actually expired.
+type MemoryStore struct {
+	shards []*memoryShard
+	opts   MemoryStoreOptions
+	saveMu sync.Mutex
+
+	dirty           atomic.Bool // Snapshot mode: token changes not yet written
+	challengesDirty atomic.Bool // Challenge changes not yet written
+	journalMu       sync.Mutex
+	journal         *os.File
+	journalBuf      *bufio.Writer
+	journalEntries  int
+	compacting      atomic.Bool    // A compaction started by a full journal is running
+	compactions     sync.WaitGroup // Compactions running in the background
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// MemoryStoreOptions contains configuration options for a MemoryStore
+type MemoryStoreOptions struct {
+	State         *ChallengeState // State of a single-shard store (default: new empty state)
+	Shards        int             // Number of lock-striped shards; State is ignored when above 1 (default: 1)
+	Path          string          // Tokens file; empty disables persistence
+	Fsync         bool            // Whether to fsync the tokens file, journal and directory after writes
+	WriteBehindMs int             // Coalesce writes, flushing at most once per interval in milliseconds (default: 0, write on every change)
+	Journal       bool            // Whether to append changes to {Path}.journal instead of rewriting the tokens file
+	CompactEvery  int             // Journal entries after which the journal is compacted into the tokens file (default: DefaultJournalCompactEvery)
+
+	ChallengesPath string // Challenges file, written like the tokens file on every change or write-behind tick; empty keeps challenges in memory only
+	Logger         Logger // Receiver of warnings about persistence (default: printed to stdout)
+}
+
+// memoryShard holds the challenges and tokens whose keys hash to it
+type memoryShard struct {
+	mu    sync.Mutex
+	state *ChallengeState
+
+	expiry     expiryHeap
+	challenges int // Challenges in the heap, to notice changes made to state directly
+	tokens     int // Tokens in the heap, to notice changes made to state directly
+}
+
+// NewMemoryStore creates a single-shard MemoryStore backed by state. If path is
+// not empty, tokens are loaded from and saved to that file.
+func NewMemoryStore(state *ChallengeState, path string) *MemoryStore {
+	return NewMemoryStoreWithOptions(MemoryStoreOptions{State: state, Path: path})
+}
+
+// NewShardedMemoryStore creates a MemoryStore split into the given number of
+// shards, so operations on different keys don't contend for one lock
+func NewShardedMemoryStore(shards int, path string) *MemoryStore {
+	return NewMemoryStoreWithOptions(MemoryStoreOptions{Shards: shards, Path: path})
+}
+
+// NewMemoryStoreWithOptions creates a MemoryStore with the given options. Call
+// Close to stop write-behind flushing and write outstanding changes.
+func NewMemoryStoreWithOptions(opts MemoryStoreOptions) *MemoryStore {
+	states := []*ChallengeState{opts.State}
+	if opts.Shards > 1 {
+		states = make([]*ChallengeState, opts.Shards)
+	}
+	if opts.CompactEvery <= 0 {
+		opts.CompactEvery = DefaultJournalCompactEvery
+	}
+
+	s := &MemoryStore{opts: opts}
+	for _, state := range states {
+		if state == nil {
+			state = &ChallengeState{}
+		}
+		if state.ChallengesList == nil {
+			state.ChallengesList = make(map[string]*ChallengeData)
+		}
+		if state.TokensList == nil {
+			state.TokensList = make(map[string]int64)
+		}
+		if state.TokensData == nil {
+			state.TokensData = make(map[string]*TokenData)
+		}
+		s.shards = append(s.shards, &memoryShard{state: state})
+	}
+
+	if opts.Path != "" {
+		s.loadTokens()
+	}
+	if opts.ChallengesPath != "" {
+		s.loadChallenges()
+	}
+	for _, shard := range s.shards {
+		shard.reindex()
+	}
+
+	if (opts.Path != "" || opts.ChallengesPath != "") && opts.WriteBehindMs > 0 {
+		s.startWriteBehind(time.Duration(opts.WriteBehindMs) * time.Millisecond)
+	}
+
+	return s
+}
+
+// shard returns the shard responsible for key
+func (s *MemoryStore) shard(key string) *memoryShard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// PutChallenge stores a challenge under its token
+func (s *MemoryStore) PutChallenge(ctx context.Context, token string, data *ChallengeData) error {
+	shard := s.shard(token)
+	shard.mu.Lock()
+	if _, exists := shard.state.ChallengesList[token]; !exists {
+		shard.challenges++
+	}
+	shard.state.ChallengesList[token] = data
+	shard.expiry.schedule(token, data.Expires, true)
+	s.challengesDirty.Store(true)
+	shard.mu.Unlock()
+
+	s.afterChallengeWrite(ctx)
+	return nil
+}
+
+// GetChallenge returns the challenge stored under token, or nil if there is none
+func (s *MemoryStore) GetChallenge(ctx context.Context, token string) (*ChallengeData, error) {
+	shard := s.shard(token)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	return shard.state.ChallengesList[token], nil
+}
+
+// DeleteChallenge removes a challenge and reports whether it was present
+func (s *MemoryStore) DeleteChallenge(ctx context.Context, token string) (bool, error) {
+	shard := s.shard(token)
+	shard.mu.Lock()
+	_, exists := shard.state.ChallengesList[token]
+	if exists {
+		delete(shard.state.ChallengesList, token)
+		shard.challenges--
+		s.challengesDirty.Store(true)
+	}
+	shard.mu.Unlock()
+
+	if exists {
+		s.afterChallengeWrite(ctx)
+	}
+	return exists, nil
+}
+
+// PutToken stores a verification token and persists the token file
+func (s *MemoryStore) PutToken(ctx context.Context, key string, data *TokenData) error {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	if _, exists := shard.state.TokensList[key]; !exists {
+		shard.tokens++
+	}
+	shard.state.TokensList[key] = data.Expires
+	shard.expiry.schedule(key, data.Expires, false)
+	if data.hasMeta() {
+		stored := *data
+		shard.state.TokensData[key] = &stored
+	} else {
+		delete(shard.state.TokensData, key)
+	}
+	s.recordPut(ctx, key, data)
+	shard.mu.Unlock()
+
+	s.afterWrite(ctx)
+	return nil
+}
+
+// ConsumeToken returns the unexpired token stored under key, removing it unless keep is true
+func (s *MemoryStore) ConsumeToken(ctx context.Context, key string, keep bool) (*TokenData, error) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+
+	expires, exists := shard.state.TokensList[key]
+	if !exists {
+		shard.mu.Unlock()
+		return nil, nil
+	}
+	if expires < time.Now().UnixMilli() {
+		shard.deleteToken(key)
+		shard.mu.Unlock()
+		return nil, ErrTokenExpired
+	}
+
+	data := &TokenData{Expires: expires}
+	if meta, exists := shard.state.TokensData[key]; exists {
+		stored := *meta
+		data = &stored
+	}
+
+	if keep {
+		shard.mu.Unlock()
+		return data, nil
+	}
+
+	shard.deleteToken(key)
+	s.recordDelete(ctx, key)
+	shard.mu.Unlock()
+
+	s.afterWrite(ctx)
+	return data, nil
+}
+
+// Sweep removes expired challenges and tokens from memory
+func (s *MemoryStore) Sweep(ctx context.Context, now int64) (bool, error) {
+	tokensChanged := false
+	for _, shard := range s.shards {
+		if shard.sweep(now) {
+			tokensChanged = true
+		}
+	}
+	return tokensChanged, nil
+}
+
+// Flush writes all tokens to the storage file, or in journal mode writes out
+// the buffered journal entries, and outstanding challenges to the challenges
+// file if enabled. The journal is only compacted every CompactEvery entries and
+// on Close, so flushing costs time proportional to the changes, not the tokens.
+func (s *MemoryStore) Flush(ctx context.Context) error {
+	if s.opts.ChallengesPath != "" && s.challengesDirty.Load() {
+		if err := s.saveChallenges(); err != nil {
+			return err
+		}
+	}
+
+	if s.opts.Path == "" {
+		return nil
+	}
+	if s.opts.Journal {
+		s.journalMu.Lock()
+		defer s.journalMu.Unlock()
+		return s.flushJournalLocked()
+	}
+	return s.saveTokens()
+}
+
+// deleteToken removes a token and its extra data
+func (sh *memoryShard) deleteToken(key string) {
+	if _, exists := sh.state.TokensList[key]; exists {
+		delete(sh.state.TokensList, key)
+		sh.tokens--
+	}
+	delete(sh.state.TokensData, key)
+}
+
+// sweep removes the shard's expired entries and reports whether any tokens were removed
+func (sh *memoryShard) sweep(now int64) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	// Rebuild the index if state was changed directly, or if most of the heap
+	// is entries for challenges and tokens that were already removed
+	live := sh.challenges + sh.tokens
+	if len(sh.state.ChallengesList) != sh.challenges || len(sh.state.TokensList) != sh.tokens ||
+		len(sh.expiry) > 2*live+1024 {
+		sh.reindex()
+	}
+
+	tokensChanged := false
+	for {
+		entry, ok := sh.expiry.popExpired(now)
+		if !ok {
+			break
+		}
+
+		if entry.challenge {
+			if v, exists := sh.state.ChallengesList[entry.key]; exists && v.Expires == entry.expires {
+				delete(sh.state.ChallengesList, entry.key)
+				sh.challenges--
+			}
+			continue
+		}
+
+		if v, exists := sh.state.TokensList[entry.key]; exists && v == entry.expires {
+			sh.deleteToken(entry.key)
+			tokensChanged = true
+		}
+	}
+
+	return tokensChanged
+}
+
+// reindex rebuilds the expiry heap from the state maps
+func (sh *memoryShard) reindex() {
+	sh.expiry = make(expiryHeap, 0, len(sh.state.ChallengesList)+len(sh.state.TokensList))
+	for k, v := range sh.state.ChallengesList {
+		sh.expiry = append(sh.expiry, expiryEntry{expires: v.Expires, key: k, challenge: true})
+	}
+	for k, v := range sh.state.TokensList {
+		sh.expiry = append(sh.expiry, expiryEntry{expires: v, key: k})
+	}
+	heap.Init(&sh.expiry)
+
+	sh.challenges = len(sh.state.ChallengesList)
+	sh.tokens = len(sh.state.TokensList)
+}
@@ -0,0 +1,211 @@
+package capserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// testStore runs the behaviour every Store implementation must provide
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now().UnixMilli()
+
+	// Challenges
+	challenge := &ChallengeData{
+		Challenge: []ChallengeTuple{{"salt", "ab"}},
+		Expires:   now + 60000,
+		Token:     "challenge1",
+	}
+	if err := store.PutChallenge(ctx, "challenge1", challenge); err != nil {
+		t.Fatalf("PutChallenge failed: %v", err)
+	}
+
+	got, err := store.GetChallenge(ctx, "challenge1")
+	if err != nil {
+		t.Fatalf("GetChallenge failed: %v", err)
+	}
+	if got == nil || got.Token != "challenge1" || got.Expires != challenge.Expires {
+		t.Fatalf("Expected stored challenge, got %+v", got)
+	}
+	if len(got.Challenge) != 1 || got.Challenge[0] != challenge.Challenge[0] {
+		t.Errorf("Expected challenge tuples to round-trip, got %v", got.Challenge)
+	}
+
+	missing, err := store.GetChallenge(ctx, "missing")
+	if err != nil {
+		t.Fatalf("GetChallenge failed: %v", err)
+	}
+	if missing != nil {
+		t.Error("Expected nil for missing challenge")
+	}
+
+	deleted, err := store.DeleteChallenge(ctx, "challenge1")
+	if err != nil {
+		t.Fatalf("DeleteChallenge failed: %v", err)
+	}
+	if !deleted {
+		t.Error("Expected first delete to report the challenge as present")
+	}
+	deleted, err = store.DeleteChallenge(ctx, "challenge1")
+	if err != nil {
+		t.Fatalf("DeleteChallenge failed: %v", err)
+	}
+	if deleted {
+		t.Error("Expected second delete to report the challenge as absent")
+	}
+
+	// Tokens
+	if err := store.PutToken(ctx, "id:hash", &TokenData{Expires: now + 60000}); err != nil {
+		t.Fatalf("PutToken failed: %v", err)
+	}
+
+	kept, err := store.ConsumeToken(ctx, "id:hash", true)
+	if err != nil {
+		t.Fatalf("ConsumeToken failed: %v", err)
+	}
+	if kept == nil || kept.Expires != now+60000 {
+		t.Fatalf("Expected kept token data, got %+v", kept)
+	}
+
+	consumed, err := store.ConsumeToken(ctx, "id:hash", false)
+	if err != nil {
+		t.Fatalf("ConsumeToken failed: %v", err)
+	}
+	if consumed == nil {
+		t.Fatal("Expected token to still be present after keep")
+	}
+
+	consumed, err = store.ConsumeToken(ctx, "id:hash", false)
+	if err != nil {
+		t.Fatalf("ConsumeToken failed: %v", err)
+	}
+	if consumed != nil {
+		t.Error("Expected token to be single-use")
+	}
+
+	// Expiry
+	if err := store.PutToken(ctx, "expired:hash", &TokenData{Expires: now - 1000}); err != nil {
+		t.Fatalf("PutToken failed: %v", err)
+	}
+	consumed, err = store.ConsumeToken(ctx, "expired:hash", true)
+	if err != nil && !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("ConsumeToken failed: %v", err)
+	}
+	if consumed != nil {
+		t.Error("Expected expired token to be rejected")
+	}
+
+	if err := store.PutChallenge(ctx, "old", &ChallengeData{Expires: now - 1000, Token: "old"}); err != nil {
+		t.Fatalf("PutChallenge failed: %v", err)
+	}
+	if err := store.PutToken(ctx, "old:hash", &TokenData{Expires: now - 1000}); err != nil {
+		t.Fatalf("PutToken failed: %v", err)
+	}
+	if err := store.PutToken(ctx, "live:hash", &TokenData{Expires: now + 60000}); err != nil {
+		t.Fatalf("PutToken failed: %v", err)
+	}
+
+	if _, err := store.Sweep(ctx, now); err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+
+	old, err := store.GetChallenge(ctx, "old")
+	if err != nil {
+		t.Fatalf("GetChallenge failed: %v", err)
+	}
+	if old != nil {
+		t.Error("Expected expired challenge to be swept")
+	}
+	live, err := store.ConsumeToken(ctx, "live:hash", true)
+	if err != nil {
+		t.Fatalf("ConsumeToken failed: %v", err)
+	}
+	if live == nil {
+		t.Error("Expected unexpired token to survive sweep")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(nil, ""))
+}
+
+func TestMemoryStoreExpiryIndex(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(nil, "")
+	now := time.Now().UnixMilli()
+
+	// A re-issued token leaves a stale heap entry for its earlier expiry
+	store.PutToken(ctx, "reissued", &TokenData{Expires: now - 10})
+	store.PutToken(ctx, "reissued", &TokenData{Expires: now + 60000})
+	store.PutChallenge(ctx, "solved", &ChallengeData{Expires: now - 10})
+	store.DeleteChallenge(ctx, "solved")
+	store.PutChallenge(ctx, "expired", &ChallengeData{Expires: now - 10})
+
+	changed, err := store.Sweep(ctx, now)
+	if err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	if changed {
+		t.Error("Expected no tokens to be reported as swept")
+	}
+	if _, exists := store.shards[0].state.TokensList["reissued"]; !exists {
+		t.Error("Expected re-issued token to survive its stale heap entry")
+	}
+	if len(store.shards[0].state.ChallengesList) != 0 {
+		t.Errorf("Expected expired challenge to be swept, got %d", len(store.shards[0].state.ChallengesList))
+	}
+	if len(store.shards[0].expiry) != 1 {
+		t.Errorf("Expected only the live token to remain indexed, got %d entries", len(store.shards[0].expiry))
+	}
+
+	// Entries written to state directly are picked up
+	store.shards[0].state.TokensList["direct"] = now - 10
+	changed, _ = store.Sweep(ctx, now)
+	if !changed {
+		t.Error("Expected directly added token to be swept")
+	}
+	if _, exists := store.shards[0].state.TokensList["direct"]; exists {
+		t.Error("Expected directly added token to be removed")
+	}
+}
+
+func TestMemoryStorePersistence(t *testing.T) {
+	testFile := "./test_memory_store.json"
+	defer os.Remove(testFile)
+
+	ctx := context.Background()
+	store := NewMemoryStore(nil, testFile)
+	if err := store.PutToken(ctx, "id:hash", &TokenData{Expires: time.Now().UnixMilli() + 60000}); err != nil {
+		t.Fatalf("PutToken failed: %v", err)
+	}
+
+	reloaded := NewMemoryStore(nil, testFile)
+	data, err := reloaded.ConsumeToken(ctx, "id:hash", false)
+	if err != nil {
+		t.Fatalf("ConsumeToken failed: %v", err)
+	}
+	if data == nil {
+		t.Error("Expected token to be loaded from file")
+	}
+}
+
+func TestCustomStore(t *testing.T) {
+	state := &ChallengeState{
+		ChallengesList: make(map[string]*ChallengeData),
+		TokensList:     make(map[string]int64),
+	}
+	store := NewMemoryStore(state, "")
+	cap := New(&CapConfig{Store: store})
+
+	challenge, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 1, Store: true})
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	if _, exists := state.ChallengesList[challenge.Token]; !exists {
+		t.Error("Expected challenge to be written to the custom store")
+	}
+}
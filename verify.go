@@ -0,0 +1,107 @@
+package capserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// maxNonceLength bounds the nonces hashed during verification. Solvers count
+// up from zero, so real nonces are far shorter.
+const maxNonceLength = 64
+
+// verifyTuples checks that every challenge has a [salt, target, nonce] tuple
+// solving it, returning ErrSolutionMissing or ErrSolutionInvalid if not.
+// Submissions are indexed by salt, and extra or duplicate entries and
+// oversized nonces are rejected before anything is hashed.
+func verifyTuples(ctx context.Context, challenges []ChallengeTuple, tuples []SolutionTuple, check nonceCheck, maxHashes int) error {
+	if len(tuples) > len(challenges) {
+		return ErrSolutionInvalid
+	}
+
+	bySalt := make(map[string]*SolutionTuple, len(tuples))
+	for i := range tuples {
+		if _, exists := bySalt[tuples[i].Salt]; exists {
+			return ErrSolutionInvalid
+		}
+		bySalt[tuples[i].Salt] = &tuples[i]
+	}
+
+	nonces := make([]string, len(challenges))
+	for i, challenge := range challenges {
+		sol, exists := bySalt[challenge[0]]
+		if !exists || sol.Target != challenge[1] {
+			return ErrSolutionMissing
+		}
+		nonces[i] = sol.Nonce
+	}
+
+	return checkNonces(ctx, challenges, nonces, check, maxHashes)
+}
+
+// verifyNonces checks that nonces solve the challenges they are matched to by position
+func verifyNonces(ctx context.Context, challenges []ChallengeTuple, nonces []string, check nonceCheck, maxHashes int) error {
+	if len(nonces) < len(challenges) {
+		return ErrSolutionMissing
+	}
+	if len(nonces) > len(challenges) {
+		return ErrSolutionInvalid
+	}
+	return checkNonces(ctx, challenges, nonces, check, maxHashes)
+}
+
+// checkNonces hashes nonces[i] against challenges[i], stopping at the first
+// failure. It refuses to start if that would take more than maxHashes hashes
+// or hash an oversized nonce.
+func checkNonces(ctx context.Context, challenges []ChallengeTuple, nonces []string, check nonceCheck, maxHashes int) error {
+	if len(challenges) > maxHashes {
+		return ErrSolutionInvalid
+	}
+	for _, nonce := range nonces {
+		if len(nonce) > maxNonceLength {
+			return ErrSolutionInvalid
+		}
+	}
+
+	for i, challenge := range challenges {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !check(challenge[0], challenge[1], nonces[i]) {
+			return ErrSolutionInvalid
+		}
+	}
+	return nil
+}
+
+// nonceCheck reports whether nonce solves the challenge of salt and target
+type nonceCheck func(salt, target, nonce string) bool
+
+// checkNonce reports whether the SHA-256 hash of salt+nonce starts with target
+func checkNonce(salt, target, nonce string) bool {
+	hash := sha256.Sum256([]byte(salt + nonce))
+	return matchesTarget(hash[:], target, false)
+}
+
+// checkNonceThreshold reports whether the SHA-256 hash of salt+nonce, read as
+// a hex number cut to the length of target, is at most target
+func checkNonceThreshold(salt, target, nonce string) bool {
+	hash := sha256.Sum256([]byte(salt + nonce))
+	return matchesTarget(hash[:], target, true)
+}
+
+// matchesTarget reports whether the hex form of digest starts with target or,
+// for a threshold, whether its prefix of the same length is at most target
+func matchesTarget(digest []byte, target string, threshold bool) bool {
+	var buf [128]byte
+	n := len(target)
+	if n > 2*len(digest) || n > len(buf) {
+		return false
+	}
+
+	hex.Encode(buf[:], digest[:(n+1)/2])
+	if threshold {
+		return string(buf[:n]) <= target
+	}
+	return string(buf[:n]) == target
+}
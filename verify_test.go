@@ -0,0 +1,123 @@
+package capserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testChallenges returns count distinct challenges of difficulty 1 with their solutions
+func testChallenges(t testing.TB, count int) ([]ChallengeTuple, []SolutionTuple) {
+	t.Helper()
+	challenges := ChallengeSeed{Count: count, Size: 16, Difficulty: 1}.Challenges("test")
+	tuples := make([]SolutionTuple, count)
+	for i, nonce := range solveWith(t, SHA256(), challenges, false) {
+		tuples[i] = SolutionTuple{Salt: challenges[i][0], Target: challenges[i][1], Nonce: nonce}
+	}
+	return challenges, tuples
+}
+
+func TestVerifyTuples(t *testing.T) {
+	challenges, solved := testChallenges(t, 4)
+
+	tests := []struct {
+		name   string
+		mutate func(tuples []SolutionTuple) []SolutionTuple
+		want   error
+	}{
+		{"valid", func(s []SolutionTuple) []SolutionTuple { return s }, nil},
+		{"any order", func(s []SolutionTuple) []SolutionTuple { return []SolutionTuple{s[3], s[1], s[2], s[0]} }, nil},
+		{"missing", func(s []SolutionTuple) []SolutionTuple { return s[:3] }, ErrSolutionMissing},
+		{"unknown salt", func(s []SolutionTuple) []SolutionTuple { s[2].Salt = "unknown"; return s }, ErrSolutionMissing},
+		{"wrong target", func(s []SolutionTuple) []SolutionTuple { s[2].Target += "0"; return s }, ErrSolutionMissing},
+		{"duplicate", func(s []SolutionTuple) []SolutionTuple { s[3] = s[0]; return s }, ErrSolutionInvalid},
+		{"extra entry", func(s []SolutionTuple) []SolutionTuple { return append(s, s[0]) }, ErrSolutionInvalid},
+		{"wrong nonce", func(s []SolutionTuple) []SolutionTuple {
+			s[1].Nonce = failingNonce(s[1].Salt, s[1].Target)
+			return s
+		}, ErrSolutionInvalid},
+		{"oversized nonce", func(s []SolutionTuple) []SolutionTuple {
+			s[1].Nonce = strings.Repeat("0", maxNonceLength+1)
+			return s
+		}, ErrSolutionInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tuples := tt.mutate(append([]SolutionTuple(nil), solved...))
+			if err := verifyTuples(context.Background(), challenges, tuples, checkNonce, DefaultMaxSolutionHashes); err != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	// The hash budget is checked before hashing
+	if err := verifyTuples(context.Background(), challenges, solved, checkNonce, 3); err != ErrSolutionInvalid {
+		t.Errorf("Expected the hash budget to be enforced, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := verifyTuples(ctx, challenges, solved, checkNonce, DefaultMaxSolutionHashes); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCheckNonce(t *testing.T) {
+	// sha256("a0") = 4e1195df...
+	for target, want := range map[string]bool{"4": true, "4e": true, "4e1": true, "4f": false, "5": false, "": true} {
+		if got := checkNonce("a", target, "0"); got != want {
+			t.Errorf("checkNonce(%q) = %v, want %v", target, got, want)
+		}
+	}
+	if checkNonce("a", strings.Repeat("0", 65), "0") {
+		t.Error("Expected a target longer than the hash to fail")
+	}
+}
+
+func TestMaxSolutionHashes(t *testing.T) {
+	cap := New(&CapConfig{NoFSState: true, MaxSolutionHashes: 10})
+	defer cap.Close()
+
+	if _, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 11, Store: true}); err == nil {
+		t.Error("Expected a challenge count above MaxSolutionHashes to be refused")
+	}
+	if _, err := cap.CreateChallenge(&ChallengeConfig{ChallengeCount: 10, Store: true}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func BenchmarkVerifyTuples(b *testing.B) {
+	for _, count := range []int{50, 500, 5000} {
+		b.Run(fmt.Sprintf("count=%d", count), func(b *testing.B) {
+			challenges, tuples := testChallenges(b, count)
+			ctx := context.Background()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := verifyTuples(ctx, challenges, tuples, checkNonce, DefaultMaxSolutionHashes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkVerifyNonces(b *testing.B) {
+	for _, count := range []int{50, 500, 5000} {
+		b.Run(fmt.Sprintf("count=%d", count), func(b *testing.B) {
+			challenges, tuples := testChallenges(b, count)
+			nonces := make([]string, count)
+			for i := range tuples {
+				nonces[i] = tuples[i].Nonce
+			}
+			ctx := context.Background()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := verifyNonces(ctx, challenges, nonces, checkNonce, DefaultMaxSolutionHashes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}